@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AppendAsync(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 4096
+	defaultConfig.SyncInterval = 60 * 1000 // Only explicit syncs make records durable
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	const writers, recordsPerWriter = 8, 100
+	var futuresLock sync.Mutex
+	var futures []*wal.AppendFuture
+	var group sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for i := 0; i < recordsPerWriter; i++ {
+				future := walog.AppendAsync([]byte(fmt.Sprintf("writer-%d-record-%d", writer, i)))
+				futuresLock.Lock()
+				futures = append(futures, future)
+				futuresLock.Unlock()
+			}
+		}()
+	}
+	group.Wait()
+
+	seen := make(map[uint64]bool)
+	var newest *wal.AppendFuture
+	for _, future := range futures {
+		lsn, err := future.Wait()
+		assert.NoError(t, err, "Failed to append record")
+		assert.False(t, seen[lsn], "LSN %d was handed out twice", lsn)
+		seen[lsn] = true
+		if lsn == writers*recordsPerWriter {
+			newest = future
+		}
+	}
+	assert.Len(t, seen, writers*recordsPerWriter)
+
+	// Written is not durable, that takes a sync. Rotation syncs the sealed
+	// segments, but never the record written last.
+	select {
+	case <-newest.Durable():
+		t.Fatal("Record was durable before any sync")
+	default:
+	}
+	assert.NoError(t, walog.Sync(), "Failed to sync logger")
+	for _, future := range futures {
+		_, err := future.WaitDurable()
+		assert.NoError(t, err, "Record did not become durable")
+	}
+
+	// Queued records are written by Close, later ones are rejected
+	last := walog.AppendAsync([]byte("last"))
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	lsn, err := last.WaitDurable()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(writers*recordsPerWriter+1), lsn)
+
+	_, err = walog.AppendAsync([]byte("too late")).Wait()
+	assert.ErrorIs(t, err, wal.ErrLoggerClosed)
+
+	assertContiguous(t, walog, lsn)
+}
+
+func Test_FailedSyncFailsPendingFutures(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.EnableForceSync = true
+	defaultConfig.SyncInterval = 60 * 1000 // Only explicit syncs make records durable
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	synced := walog.AppendAsync([]byte("synced"))
+	_, err = synced.Wait()
+	assert.NoError(t, err, "Failed to append record")
+	assert.NoError(t, walog.Sync(), "Failed to sync logger")
+
+	lost := walog.AppendAsync([]byte("lost"))
+	_, err = lost.Wait()
+	assert.NoError(t, err, "Failed to append record")
+	faultFS.Inject(wal.Fault{Op: wal.FaultOpSync, Path: wal.SegmentPrefix})
+	assert.ErrorIs(t, walog.Sync(), wal.ErrInjectedFault)
+	_, err = lost.WaitDurable()
+	assert.ErrorIs(t, err, wal.ErrInjectedFault, "A record whose sync failed is not durable")
+
+	// The next sync succeeds on disk, but can not bring back what the failed one lost
+	later := walog.AppendAsync([]byte("later"))
+	_, err = later.Wait()
+	assert.NoError(t, err, "Failed to append record")
+	assert.ErrorIs(t, walog.Sync(), wal.ErrInjectedFault)
+	_, err = later.WaitDurable()
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+	lsn, err := synced.WaitDurable()
+	assert.NoError(t, err, "Records synced before the failure stay durable")
+	assert.Equal(t, uint64(1), lsn)
+	assert.ErrorIs(t, walog.Close(), wal.ErrInjectedFault)
+}
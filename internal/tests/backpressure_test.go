@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WriteRecordContext(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.SyncInterval = 60 * 1000 // Keep the background sync out of the way
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, walog.WriteRecordContext(ctx, []byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	assert.ErrorIs(t, walog.WriteRecordContext(canceled, []byte("never written")), context.Canceled)
+
+	// WriteRecordContext only returns once the record is durable
+	memFS.Crash()
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to recover logger")
+	assertContiguous(t, walog, 5)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_WriteRecordContextAfterFailedSync(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.EnableForceSync = true
+	defaultConfig.SyncInterval = 60 * 1000 // Keep the background sync out of the way
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	ctx := context.Background()
+	assert.NoError(t, walog.WriteRecordContext(ctx, []byte("durable")), "Failed to write record")
+
+	// The fault fires once, yet the records behind the failed sync never become durable
+	assert.NoError(t, walog.WriteRecord([]byte("lost")), "Failed to write record")
+	faultFS.Inject(wal.Fault{Op: wal.FaultOpSync, Path: wal.SegmentPrefix})
+	assert.ErrorIs(t, walog.Sync(), wal.ErrInjectedFault)
+	assert.ErrorIs(t, walog.WriteRecordContext(ctx, []byte("after")), wal.ErrInjectedFault)
+	assert.Equal(t, 1, faultFS.Triggered())
+}
+
+func Test_MaxInFlightBytes(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.SyncInterval = 60 * 1000
+	defaultConfig.MaxInFlightBytes = 256
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 100)
+
+	// Writers had to sync whenever 256 bytes were unsynced, so a crash can
+	// only lose the last few records
+	memFS.Crash()
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to recover logger")
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.GreaterOrEqual(t, len(records), 90)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_RejectWhenFull(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.SyncInterval = 60 * 1000
+	defaultConfig.MaxInFlightBytes = 256
+	defaultConfig.RejectWhenFull = true
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	written := 0
+	for ; written < 100; written++ {
+		err = walog.WriteRecord(make([]byte, 40))
+		if err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, wal.ErrBackpressure)
+	assert.Greater(t, written, 0)
+
+	// A sync drains the in-flight bytes and writes are accepted again
+	assert.NoError(t, walog.Sync(), "Failed to sync logger")
+	assert.NoError(t, walog.WriteRecord(make([]byte, 40)), "Write after sync must succeed")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assertContiguous(t, walog, uint64(written+1))
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"walstore/internal/wal"
+)
+
+// startBenchLogger starts a logger on the real file system, skipping the
+// benchmark when the sync mode cannot be used here.
+func startBenchLogger(b *testing.B, syncMode wal.SyncMode) *wal.WriteAheadLog {
+	if !syncMode.Supported() {
+		b.Skipf("Sync mode %s is not supported on this platform", syncMode)
+	}
+
+	defaultConfig := wal.CreateDefaultConfig(b.TempDir())
+	defaultConfig.SyncMode = syncMode
+
+	walog, err := wal.StartLogger(defaultConfig)
+	if errors.Is(err, syscall.EINVAL) {
+		b.Skipf("File system does not support %s", syncMode) // e.g. O_DIRECT on tmpfs
+	}
+	if err != nil {
+		b.Fatalf("Failed to start logger: %v", err)
+	}
+	b.Cleanup(func() { walog.Close() })
+	return walog
+}
+
+// BenchmarkWriteRecord measures WriteRecord alone, with the periodic sync in
+// the background, for several payload sizes and sync modes.
+func BenchmarkWriteRecord(b *testing.B) {
+	for _, payloadSize := range []int{64, 1024, 16 * 1024} {
+		for _, syncMode := range allSyncModes {
+			b.Run(fmt.Sprintf("%dB/%s", payloadSize, syncMode), func(b *testing.B) {
+				walog := startBenchLogger(b, syncMode)
+				payload := make([]byte, payloadSize)
+
+				b.SetBytes(int64(payloadSize))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := walog.WriteRecord(payload); err != nil {
+						b.Fatalf("Failed to write record: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSyncModes measures a durable write, a record followed by a sync,
+// for every sync mode on the real file system.
+func BenchmarkSyncModes(b *testing.B) {
+	payload := make([]byte, 256)
+	for _, syncMode := range allSyncModes {
+		b.Run(syncMode.String(), func(b *testing.B) {
+			walog := startBenchLogger(b, syncMode)
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := walog.WriteRecord(payload); err != nil {
+					b.Fatalf("Failed to write record: %v", err)
+				}
+				if err := walog.Sync(); err != nil {
+					b.Fatalf("Failed to sync: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadAt measures looking up random records through the sparse index.
+func BenchmarkReadAt(b *testing.B) {
+	walog := startBenchLogger(b, wal.SyncModeFsync)
+	payload := make([]byte, 256)
+	const records = 20000
+	for i := 0; i < records; i++ {
+		if err := walog.WriteRecord(payload); err != nil {
+			b.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lsn := uint64(i*7919%records) + 1
+		if _, err := walog.ReadAt(lsn); err != nil {
+			b.Fatalf("Failed to read lsn %d: %v", lsn, err)
+		}
+	}
+}
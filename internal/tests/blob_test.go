@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blobRecordSize(i int) int {
+	if i%3 == 0 {
+		return 6000
+	}
+	return 100
+}
+
+func Test_BlobFiles(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.MaxFileSize = 4096
+	defaultConfig.MaxSegments = 1000
+	defaultConfig.BlobThreshold = 512
+	defaultConfig.HashChain = true
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 30; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, blobRecordSize(i))), "Failed to write record")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Segments only hold pointers to the large records
+	segmentFiles, err := faultFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	var segmentBytes int64
+	for _, segmentFile := range segmentFiles {
+		fileInfo, err := faultFS.Stat(segmentFile)
+		assert.NoError(t, err)
+		segmentBytes += fileInfo.Size()
+	}
+	assert.Less(t, segmentBytes, int64(10*6000))
+	blobFiles, err := faultFS.Glob("/wal/" + wal.BlobPrefix + "*.blob")
+	assert.NoError(t, err)
+	assert.Len(t, blobFiles, 10)
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	if assert.Len(t, records, 30) {
+		for i, record := range records {
+			assert.Equal(t, framedRecord(i+1, blobRecordSize(i+1)), record.GetData())
+			assert.Nil(t, record.GetBlob())
+		}
+	}
+	record, err := walog.ReadAt(12)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, framedRecord(12, 6000), record.GetData())
+	newest, err := walog.LastRecords(3)
+	assert.NoError(t, err, "Failed to read records backwards")
+	if assert.Len(t, newest, 3) {
+		assert.Equal(t, framedRecord(30, 6000), newest[0].GetData())
+	}
+	assert.NoError(t, walog.VerifyChain(1, math.MaxUint64), "Hash chain must cover the blobs")
+
+	reader, err := walog.OpenRecord(15)
+	if assert.NoError(t, err, "Failed to open record") {
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, err, "Failed to read record")
+		assert.Equal(t, framedRecord(15, 6000), data)
+		assert.NoError(t, reader.Close())
+	}
+
+	// Blobs are checked against the checksum in their pointer
+	assert.NoError(t, faultFS.Corrupt(blobFiles[2], 3000, 1))
+	_, err = walog.ReadAt(9)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+	reader, err = walog.OpenRecord(9)
+	if assert.NoError(t, err, "Failed to open record") {
+		_, err = io.ReadAll(reader)
+		assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+		assert.NoError(t, reader.Close())
+	}
+}
+
+func Test_BlobFilesGarbageCollected(t *testing.T) {
+	fs := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = fs
+	defaultConfig.MaxFileSize = 4096
+	defaultConfig.MaxSegments = 3
+	defaultConfig.BlobThreshold = 512
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	for i := 1; i <= 300; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, blobRecordSize(i))), "Failed to write record")
+	}
+
+	// Blob files go with the segments pointing into them
+	blobFiles, err := fs.Glob("/wal/" + wal.BlobPrefix + "*.blob")
+	assert.NoError(t, err)
+	assert.Less(t, len(blobFiles), 50)
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.NotEmpty(t, records)
+	for _, record := range records {
+		i := int(record.GetLogSequenceNumber())
+		assert.Equal(t, framedRecord(i, blobRecordSize(i)), record.GetData())
+	}
+
+	// Streamed records above the threshold go to blob files as well
+	payload := bytes.Repeat([]byte("blob"), 100000)
+	assert.NoError(t, walog.WriteRecordFrom(bytes.NewReader(payload), int64(len(payload))), "Failed to write record")
+	reader, err := walog.OpenRecord(301)
+	if assert.NoError(t, err, "Failed to open record") {
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, err, "Failed to read record")
+		assert.True(t, bytes.Equal(payload, data), "Streamed blob differs")
+		assert.NoError(t, reader.Close())
+	}
+	records, err = walog.LastRecords(1)
+	assert.NoError(t, err, "Failed to read records backwards")
+	if assert.Len(t, records, 1) {
+		assert.True(t, bytes.Equal(payload, records[0].GetData()), "Streamed blob differs")
+	}
+}
+
+func Test_RecoveryCutsRecordsWithLostBlobs(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 64 * 1024
+	defaultConfig.BlobThreshold = 512
+	defaultConfig.EnableForceSync = false
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 9; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, blobRecordSize(i))), "Failed to write record")
+	}
+	assert.NoError(t, walog.Sync(), "Failed to sync")
+
+	// Without fsync the segment made it to disk, but only the first blob and
+	// part of the second
+	memFS.CrashTorn(func(name string, unsynced int) int {
+		if strings.Contains(name, wal.BlobPrefix) {
+			return 9000
+		}
+		return unsynced
+	})
+	_ = walog.Close()
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to recover logger")
+	defer walog.Close()
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 5)
+
+	// The records cut off with their blobs are written again
+	assert.NoError(t, walog.WriteRecord(framedRecord(6, 6000)), "Failed to write record")
+	record, err := walog.ReadAt(6)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, framedRecord(6, 6000), record.GetData())
+}
+
+func Test_FailedBlobWriteIsDiscarded(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.MaxFileSize = 64 * 1024
+	defaultConfig.BlobThreshold = 512
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	assert.NoError(t, walog.WriteRecord(framedRecord(1, 6000)), "Failed to write record")
+
+	// The torn blob is cut off, so the next one takes its place
+	faultFS.Inject(wal.Fault{Op: wal.FaultOpWrite, Path: ".blob", ShortWrite: 100})
+	assert.ErrorIs(t, walog.WriteRecord(framedRecord(2, 6000)), wal.ErrInjectedFault)
+	faultFS.Reset()
+	assert.NoError(t, walog.WriteRecord(framedRecord(2, 6000)), "Failed to write record")
+
+	// Closing closes every file, even when one of them fails
+	faultFS.Inject(wal.Fault{Op: wal.FaultOpClose, Path: ".blob"})
+	assert.ErrorIs(t, walog.Close(), wal.ErrInjectedFault)
+	faultFS.Reset()
+
+	blobFiles, err := faultFS.Glob("/wal/" + wal.BlobPrefix + "*.blob")
+	assert.NoError(t, err)
+	if assert.Len(t, blobFiles, 1) {
+		fileInfo, err := faultFS.Stat(blobFiles[0])
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2*6000), fileInfo.Size())
+	}
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, framedRecord(2, 6000), records[1].GetData())
+	}
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"testing"
+	"walstore/internal/wal"
+	pb "walstore/proto"
+
+	"github.com/stretchr/testify/assert"
+	gpb "google.golang.org/protobuf/proto"
+)
+
+// forgeRecord rewrites the data of a record in place the way an attacker
+// would, with a valid checksum so only the hash chain can tell.
+func forgeRecord(t *testing.T, fs wal.FS, lsn uint64) {
+	segmentFiles, err := fs.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	for _, segmentFile := range segmentFiles {
+		file, err := fs.OpenFile(segmentFile, os.O_RDWR, 0644)
+		assert.NoError(t, err)
+		content, err := io.ReadAll(file)
+		assert.NoError(t, err)
+
+		for offset := 0; offset+4 <= len(content); {
+			size := int(binary.LittleEndian.Uint32(content[offset:]))
+			if size == 0 {
+				break
+			}
+			var record pb.WalRecord
+			assert.NoError(t, gpb.Unmarshal(content[offset+4:offset+4+size], &record))
+			if record.GetLogSequenceNumber() != lsn {
+				offset += 4 + size
+				continue
+			}
+
+			// Keep the encoded size, so the framing stays intact
+			for forged := byte('A'); forged <= 'Z'; forged++ {
+				record.Data[len(record.Data)-1] = forged
+				checksum := crc32.Update(crc32.ChecksumIEEE(record.Data), crc32.IEEETable, []byte{byte(lsn)})
+				record.Checksum = checksum
+				encoded, err := gpb.Marshal(&record)
+				assert.NoError(t, err)
+				if len(encoded) == size {
+					_, err = file.Seek(int64(offset+4), io.SeekStart)
+					assert.NoError(t, err)
+					_, err = file.Write(encoded)
+					assert.NoError(t, err)
+					assert.NoError(t, file.Close())
+					return
+				}
+			}
+			t.Fatalf("Failed to forge lsn %d", lsn)
+		}
+		assert.NoError(t, file.Close())
+	}
+	t.Fatalf("Record %d not found", lsn)
+}
+
+func Test_HashChain(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.HashChain = true
+	defaultConfig.ChainKey = []byte("audit-key")
+
+	// The chain continues across rotations and restarts
+	for restart := 0; restart < 2; restart++ {
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 1; i <= 50; i++ {
+			assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", restart*50+i))), "Failed to write record")
+		}
+		assert.NoError(t, walog.VerifyChain(1, math.MaxUint64), "The chain must be intact")
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+
+	forgeRecord(t, memFS, 40)
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	record, err := walog.ReadAt(40)
+	assert.NoError(t, err, "The forged record passes its checksum")
+	assert.NotEqual(t, "record-40", string(record.GetData()))
+
+	err = walog.VerifyChain(1, math.MaxUint64)
+	assert.ErrorIs(t, err, wal.ErrChainBroken)
+	var chainBreak *wal.ChainBreakError
+	if assert.ErrorAs(t, err, &chainBreak) {
+		assert.Equal(t, uint64(41), chainBreak.LSN, "The link after the forged record breaks")
+	}
+	assert.NoError(t, walog.VerifyChain(1, 39), "The records before the forgery are intact")
+	assert.NoError(t, walog.VerifyChain(42, 100), "The records after the forgery are intact")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// The chain can not be verified, or rebuilt, without the HMAC key
+	defaultConfig.ChainKey = []byte("another-key")
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	assert.ErrorAs(t, walog.VerifyChain(1, 39), &chainBreak)
+	assert.Equal(t, uint64(2), chainBreak.LSN)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_VerifyChainOfUnchainedRecords(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	assert.NoError(t, walog.WriteRecord([]byte("unchained")), "Failed to write record")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Turning the chain on links to the records written before
+	defaultConfig.HashChain = true
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	assert.NoError(t, walog.WriteRecord([]byte("chained")), "Failed to write record")
+
+	var chainBreak *wal.ChainBreakError
+	if assert.ErrorAs(t, walog.VerifyChain(1, 2), &chainBreak) {
+		assert.Equal(t, uint64(1), chainBreak.LSN)
+	}
+	assert.NoError(t, walog.VerifyChain(2, 2), "The chain starts at the first chained record")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_VerifyChainAfterRetention(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.MaxSegments = 3
+	defaultConfig.HashChain = true
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	for i := 1; i <= 100; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	oldestLSN := records[0].GetLogSequenceNumber()
+	assert.Greater(t, oldestLSN, uint64(1), "Retention did not delete any segment")
+
+	// The link of the oldest record points to a deleted one
+	err = walog.VerifyChain(1, math.MaxUint64)
+	assert.ErrorIs(t, err, wal.ErrChainUnverifiable)
+	assert.NotErrorIs(t, err, wal.ErrChainBroken)
+	assert.ErrorIs(t, walog.VerifyChain(oldestLSN, math.MaxUint64), wal.ErrChainUnverifiable)
+	assert.NoError(t, walog.VerifyChain(oldestLSN+1, math.MaxUint64), "The retained links are intact")
+}
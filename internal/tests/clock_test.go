@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"testing"
+	"time"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type syncNotifier struct {
+	wal.NoopHooks
+	synced chan wal.SegmentInfo
+}
+
+func (notifier *syncNotifier) OnSync(segment wal.SegmentInfo) {
+	notifier.synced <- segment
+}
+
+func Test_FakeClockDrivesSyncAndTimestamps(t *testing.T) {
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := wal.NewFakeClock(start)
+	notifier := &syncNotifier{synced: make(chan wal.SegmentInfo, 16)}
+
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.Clock = clock
+	defaultConfig.Hooks = notifier
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	assert.NoError(t, walog.WriteRecord([]byte("first")), "Failed to write record")
+	clock.Advance(time.Second)
+	select {
+	case segment := <-notifier.synced:
+		assert.Equal(t, uint64(1), segment.LastLSN)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Periodic sync did not run after advancing the clock")
+	}
+
+	assert.NoError(t, walog.WriteRecord([]byte("second")), "Failed to write record")
+	clock.Advance(100 * time.Millisecond) // Less than the sync interval
+	select {
+	case <-notifier.synced:
+		t.Fatal("Periodic sync ran before the interval elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 2)
+	assert.Equal(t, start.UnixNano(), records[0].GetTimestamp())
+	assert.Equal(t, start.Add(time.Second).UnixNano(), records[1].GetTimestamp())
+}
+
+func Test_StartLoggerLeavesConfigAlone(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.Clock = nil
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assert.Nil(t, defaultConfig.Clock, "Defaults must not be written back into the config")
+}
+
+func Test_SegmentsExpireByClock(t *testing.T) {
+	clock := wal.NewFakeClock(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC))
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.Clock = clock
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.MaxSegmentAge = time.Hour
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	for i := 1; i <= 100; i++ {
+		if i == 51 {
+			clock.Advance(30 * time.Minute)
+		}
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, 100)), "Failed to write record")
+	}
+	assert.NoError(t, walog.Sync(), "Failed to sync")
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 100)
+
+	// The first half ages out at the next periodic sync, even without writes
+	clock.Advance(45 * time.Minute)
+	assert.Eventually(t, func() bool {
+		records, err := walog.ReadAllSegments()
+		return err == nil && records[0].GetLogSequenceNumber() > 1
+	}, 5*time.Second, time.Millisecond)
+	records, err = walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.LessOrEqual(t, records[0].GetLogSequenceNumber(), uint64(51), "Segments with newer records must be kept")
+	assert.Equal(t, uint64(100), records[len(records)-1].GetLogSequenceNumber())
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func jsonRecord(i int) []byte {
+	if i%3 == 0 {
+		// Below the compression threshold
+		return []byte(fmt.Sprintf(`{"Op":"DELETE","Key":"key-%d"}`, i))
+	}
+	return []byte(fmt.Sprintf(`{"Op":"PUT","Key":"key-%d","Value":"%s"}`, i, strings.Repeat("value ", 50)))
+}
+
+// customCodec is a codec registered by the application.
+type customCodec struct {
+	wal.Codec
+}
+
+func (customCodec) ID() uint32 { return 100 }
+
+func Test_CompressedRecords(t *testing.T) {
+	memFS := wal.NewMemFS()
+	flateCodec, err := wal.NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err, "Failed to create codec")
+	gzipCodec, err := wal.NewGzipCodec(gzip.BestCompression)
+	assert.NoError(t, err, "Failed to create codec")
+	_, err = wal.NewFlateCodec(42)
+	assert.Error(t, err, "Invalid compression levels must be rejected")
+
+	// Segments written with flate, then gzip, then raw, then a custom codec
+	count := 0
+	for _, codec := range []wal.Codec{flateCodec, gzipCodec, nil, customCodec{flateCodec}} {
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = memFS
+		defaultConfig.MaxFileSize = 4096
+		defaultConfig.Codec = codec
+		defaultConfig.CompressionThreshold = 64
+
+		walog, err := wal.StartLogger(defaultConfig)
+		if _, ok := codec.(customCodec); ok {
+			assert.Error(t, err, "Unregistered codecs must be rejected")
+			assert.NoError(t, wal.RegisterCodec(codec), "Failed to register codec")
+			walog, err = wal.StartLogger(defaultConfig)
+		}
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 0; i < 100; i++ {
+			count++
+			assert.NoError(t, walog.WriteRecord(jsonRecord(count)), "Failed to write record")
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	defer walog.Close()
+
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, count)
+	for i, record := range records {
+		assert.Equal(t, jsonRecord(i+1), record.GetData())
+	}
+
+	for _, lsn := range []uint64{1, 150, 250, 399} {
+		record, err := walog.ReadAt(lsn)
+		if assert.NoError(t, err, "Failed to read lsn %d", lsn) {
+			assert.Equal(t, jsonRecord(int(lsn)), record.GetData())
+		}
+	}
+
+	records, err = walog.LastRecords(5)
+	assert.NoError(t, err, "Failed to read the last records")
+	for i, record := range records {
+		assert.Equal(t, jsonRecord(count-i), record.GetData())
+	}
+}
+
+func Test_CompressionSavesSpace(t *testing.T) {
+	segmentCount := func(codec wal.Codec) int {
+		memFS := wal.NewMemFS()
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = memFS
+		defaultConfig.MaxFileSize = 4096
+		defaultConfig.Codec = codec
+
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 1; i <= 100; i++ {
+			assert.NoError(t, walog.WriteRecord(jsonRecord(i)), "Failed to write record")
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+
+		segmentFiles, err := memFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+		assert.NoError(t, err)
+		return len(segmentFiles)
+	}
+
+	flateCodec, err := wal.NewFlateCodec(flate.DefaultCompression)
+	assert.NoError(t, err, "Failed to create codec")
+	assert.Less(t, segmentCount(flateCodec)*3, segmentCount(nil), "Compressed segments take a fraction of the space")
+}
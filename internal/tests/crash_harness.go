@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+	"walstore/internal/wal"
+)
+
+// CrashPoint names a place where CrashHarness pulls the plug.
+type CrashPoint int
+
+const (
+	CrashAnywhere      CrashPoint = iota // Between two writes
+	CrashBeforeFsync                     // After bufferWriter.Flush, before the segment fsync
+	CrashMidRotation                     // While rotateLog creates the next segment
+	CrashMidRetention                    // While rotateLog deletes the oldest segment
+	CrashDuringWrite                     // While flushing buffered records to the segment
+	CrashBeforeDirSync                   // After creating or deleting a segment, before the directory fsync
+	crashPointCount
+)
+
+func (point CrashPoint) String() string {
+	switch point {
+	case CrashAnywhere:
+		return "anywhere"
+	case CrashBeforeFsync:
+		return "before-fsync"
+	case CrashMidRotation:
+		return "mid-rotation"
+	case CrashMidRetention:
+		return "mid-retention"
+	case CrashDuringWrite:
+		return "during-write"
+	case CrashBeforeDirSync:
+		return "before-dir-sync"
+	}
+	return fmt.Sprintf("CrashPoint(%d)", int(point))
+}
+
+// CrashHarness repeatedly writes random batches to a WriteAheadLog on a MemFS,
+// crashes it at a chosen point, recovers with StartLogger and checks that
+//   - no record acknowledged as durable by an OnSync event was lost,
+//   - LSNs are contiguous, except for those of records that failed,
+//   - every recovered record carries exactly the payload written for its LSN.
+//
+// Set Config.BlobThreshold, Config.Framing or a MaxPayload larger than
+// Config.MaxFileSize to crash blob files, block framing or records split into
+// parts.
+type CrashHarness struct {
+	Config     *wal.Config
+	MemFS      *wal.MemFS
+	FaultFS    *wal.FaultFS
+	Rand       *rand.Rand
+	MaxPayload int // Payloads are 1 to MaxPayload random bytes
+
+	durable  durableTracker
+	payloads map[uint64][]byte // Payload written for each LSN
+}
+
+type durableTracker struct {
+	wal.NoopHooks
+	lock       sync.Mutex
+	durableLSN uint64
+}
+
+func (tracker *durableTracker) OnSync(segment wal.SegmentInfo) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.durableLSN = max(tracker.durableLSN, segment.LastLSN)
+}
+
+func (tracker *durableTracker) get() uint64 {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.durableLSN
+}
+
+func NewCrashHarness(seed int64) *CrashHarness {
+	memFS := wal.NewMemFS()
+	harness := &CrashHarness{
+		MemFS:      memFS,
+		FaultFS:    wal.NewFaultFS(memFS),
+		Rand:       rand.New(rand.NewSource(seed)),
+		MaxPayload: 300,
+		payloads:   make(map[uint64][]byte),
+	}
+
+	harness.Config = wal.CreateDefaultConfig("/wal")
+	harness.Config.FS = harness.FaultFS
+	harness.Config.MaxFileSize = 2048
+	harness.Config.MaxSegments = 6
+	harness.Config.Clock = wal.NewFakeClock(time.Unix(0, 0)) // The harness decides when to sync
+	harness.Config.Hooks = &harness.durable
+
+	return harness
+}
+
+// Run performs the given number of write/crash/recover cycles.
+func (harness *CrashHarness) Run(cycles int) error {
+	for cycle := 0; cycle < cycles; cycle++ {
+		point := CrashPoint(harness.Rand.Intn(int(crashPointCount)))
+		if err := harness.cycle(point); err != nil {
+			return fmt.Errorf("cycle %d (crash %s): %w", cycle, point, err)
+		}
+	}
+
+	walog, err := harness.recover()
+	if err != nil {
+		return err
+	}
+	return walog.Close()
+}
+
+func (harness *CrashHarness) cycle(point CrashPoint) error {
+	walog, err := harness.recover()
+	if err != nil {
+		return err
+	}
+
+	harness.arm(point)
+	harness.writeBatches(walog)
+
+	// Pull the plug, sometimes letting part of the unsynced data reach the disk
+	if harness.Rand.Intn(2) == 0 {
+		harness.MemFS.Crash()
+	} else {
+		harness.MemFS.CrashTorn(func(name string, unsynced int) int {
+			return harness.Rand.Intn(unsynced + 1)
+		})
+	}
+	harness.FaultFS.Reset()
+
+	// The abandoned logger can only fail now, closing it stops its goroutines
+	// and delivers the sync events it already produced
+	_ = walog.Close()
+	return nil
+}
+
+// arm injects the fault that ends the cycle at the given crash point.
+func (harness *CrashHarness) arm(point CrashPoint) {
+	after := harness.Rand.Intn(4)
+	segments := wal.SegmentPrefix
+	if harness.Config.SegmentNaming == wal.SegmentNamingBaseLSN {
+		segments = ".log"
+	}
+	if harness.Config.BlobThreshold > 0 && harness.Rand.Intn(2) == 0 {
+		// Fail the blob files instead, retention only removes them after their segments
+		segments = wal.BlobPrefix
+	}
+
+	switch point {
+	case CrashBeforeFsync:
+		harness.FaultFS.Inject(wal.Fault{Op: wal.FaultOpSync, Path: segments, After: after, Sticky: true})
+	case CrashMidRotation:
+		harness.FaultFS.Inject(wal.Fault{Op: wal.FaultOpOpen, Path: segments, After: after, Sticky: true})
+	case CrashMidRetention:
+		harness.FaultFS.Inject(wal.Fault{Op: wal.FaultOpRemove, Path: segments, After: after, Sticky: true})
+	case CrashDuringWrite:
+		harness.FaultFS.Inject(wal.Fault{Op: wal.FaultOpWrite, Path: segments, After: after, ShortWrite: harness.Rand.Intn(64), Sticky: true})
+	case CrashBeforeDirSync:
+		harness.FaultFS.Inject(wal.Fault{Op: wal.FaultOpSyncDir, Path: harness.Config.Directory, After: after, Sticky: true})
+	}
+}
+
+// writeBatches writes random batches until a write fails or the batch budget
+// runs out, which is where the crash happens.
+func (harness *CrashHarness) writeBatches(walog *wal.WriteAheadLog) {
+	for batch := harness.Rand.Intn(8) + 1; batch > 0; batch-- {
+		for count := harness.Rand.Intn(20) + 1; count > 0; count-- {
+			payload := make([]byte, harness.Rand.Intn(harness.MaxPayload)+1)
+			harness.Rand.Read(payload)
+
+			// The future tells the LSN, a record split into parts that
+			// failed or was cut off by a crash uses its LSN up
+			lsn, err := walog.AppendAsync(payload).Wait()
+			if err != nil {
+				return
+			}
+			harness.payloads[lsn] = payload
+		}
+
+		if harness.Rand.Intn(2) == 0 {
+			if err := walog.Sync(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// recover reopens the WAL and checks the invariants on what survived.
+func (harness *CrashHarness) recover() (*wal.WriteAheadLog, error) {
+	walog, err := wal.StartLogger(harness.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover logger: %w", err)
+	}
+
+	if err := harness.verify(walog); err != nil {
+		walog.Close()
+		return nil, err
+	}
+	return walog, nil
+}
+
+func (harness *CrashHarness) verify(walog *wal.WriteAheadLog) error {
+	records, err := walog.ReadAllSegments()
+	if err != nil {
+		return fmt.Errorf("failed to read recovered records: %w", err)
+	}
+
+	var lastLSN uint64
+	for i, record := range records {
+		lsn := record.GetLogSequenceNumber()
+		for skipped := lastLSN + 1; i > 0 && skipped < lsn; skipped++ {
+			if _, known := harness.payloads[skipped]; known {
+				return fmt.Errorf("LSN gap: %d followed by %d", lastLSN, lsn)
+			}
+		}
+		if payload, known := harness.payloads[lsn]; !known || !bytes.Equal(payload, record.GetData()) {
+			return fmt.Errorf("record %d does not hold the payload written for it", lsn)
+		}
+		lastLSN = lsn
+	}
+
+	// The recovered index must find the same records
+	if len(records) > 0 {
+		record := records[harness.Rand.Intn(len(records))]
+		indexed, err := walog.ReadAt(record.GetLogSequenceNumber())
+		if err != nil {
+			return fmt.Errorf("failed to read recovered record %d by LSN: %w", record.GetLogSequenceNumber(), err)
+		}
+		if !bytes.Equal(indexed.GetData(), record.GetData()) {
+			return fmt.Errorf("record %d read by LSN does not match", record.GetLogSequenceNumber())
+		}
+	}
+
+	durableLSN := harness.durable.get()
+	for lsn := range harness.payloads {
+		if lsn > lastLSN && lsn <= durableLSN {
+			return fmt.Errorf("%w: durable up to %d, recovered up to %d", errLostDurableRecords, durableLSN, lastLSN)
+		}
+	}
+
+	// The LSNs of the records lost are written again
+	for lsn := range harness.payloads {
+		if lsn > lastLSN {
+			delete(harness.payloads, lsn)
+		}
+	}
+	return nil
+}
+
+var errLostDurableRecords = errors.New("acknowledged durable records lost")
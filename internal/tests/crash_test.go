@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CrashConsistency(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3, 4} {
+		harness := NewCrashHarness(seed)
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
+
+func Test_CrashConsistencyWithRecycledSegments(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3, 4} {
+		harness := NewCrashHarness(seed)
+		harness.Config.PreallocateSegments = true
+		harness.Config.RecycleSegments = true
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
+
+func Test_CrashConsistencyWithBlobs(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3, 4} {
+		harness := NewCrashHarness(seed)
+		// Segments large enough for the buffer to fill up between syncs
+		harness.Config.MaxFileSize = 16 * 1024
+		harness.Config.BlobThreshold = 200
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
+
+func Test_CrashConsistencyWithBlockFraming(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3, 4} {
+		harness := NewCrashHarness(seed)
+		harness.Config.Framing = wal.FramingBlocks
+		// Records span up to three segments, retention has to keep a few of them
+		harness.MaxPayload = 5000
+		harness.Config.MaxSegments = 20
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
+
+func Test_CrashConsistencyWithParts(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3, 4} {
+		harness := NewCrashHarness(seed)
+		// Records span up to three segments, retention has to keep a few of them
+		harness.MaxPayload = 5000
+		harness.Config.MaxSegments = 20
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
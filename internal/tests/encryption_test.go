@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func secretRecord(i int) []byte {
+	return []byte(fmt.Sprintf("customer-%d:secret", i))
+}
+
+func Test_EncryptedRecords(t *testing.T) {
+	memFS := wal.NewMemFS()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+
+	keyRing, err := wal.NewKeyRing(1, oldKey)
+	assert.NoError(t, err, "Failed to create key ring")
+	assert.Error(t, keyRing.Rotate(2, []byte("short")), "Invalid keys must be rejected")
+	assert.Error(t, keyRing.Rotate(1, newKey), "Key IDs must not be reused")
+
+	flateCodec, err := wal.NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err, "Failed to create codec")
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 2048
+	defaultConfig.KeyProvider = keyRing
+	defaultConfig.Codec = flateCodec
+	defaultConfig.CompressionThreshold = 1
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 100; i++ {
+		assert.NoError(t, walog.WriteRecord(secretRecord(i)), "Failed to write record")
+		if i == 50 {
+			// New records use the new key, older ones stay readable
+			assert.NoError(t, keyRing.Rotate(2, newKey), "Failed to rotate key")
+		}
+	}
+
+	assert.NoError(t, walog.Sync(), "Failed to sync")
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 100)
+	for i, record := range records {
+		assert.Equal(t, secretRecord(i+1), record.GetData())
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// No plaintext reaches the disk
+	segmentFiles, err := memFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	for _, segmentFile := range segmentFiles {
+		file, err := memFS.OpenFile(segmentFile, os.O_RDONLY, 0644)
+		assert.NoError(t, err)
+		content, err := io.ReadAll(file)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Close())
+		assert.False(t, bytes.Contains(content, []byte("secret")), "Segment %s holds plaintext", segmentFile)
+	}
+
+	// Reading needs every key still in use
+	onlyNewKey, err := wal.NewKeyRing(2, newKey)
+	assert.NoError(t, err, "Failed to create key ring")
+	defaultConfig.KeyProvider = onlyNewKey
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	_, err = walog.ReadAt(1)
+	assert.ErrorIs(t, err, wal.ErrUnknownKey)
+	record, err := walog.ReadAt(100)
+	if assert.NoError(t, err, "Failed to read a record with the new key") {
+		assert.Equal(t, secretRecord(100), record.GetData())
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// A wrong key under a known ID fails authentication
+	wrongKey, err := wal.NewKeyRing(1, bytes.Repeat([]byte{3}, 32))
+	assert.NoError(t, err, "Failed to create key ring")
+	defaultConfig.KeyProvider = wrongKey
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	_, err = walog.ReadAt(1)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
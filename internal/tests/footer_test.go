@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SegmentFooter(t *testing.T) {
+	for _, recycle := range []bool{false, true} {
+		faultFS := wal.NewFaultFS(wal.NewMemFS())
+		start := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+		clock := wal.NewFakeClock(start)
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = faultFS
+		defaultConfig.Clock = clock
+		defaultConfig.MaxFileSize = 1024
+		defaultConfig.MaxSegments = 5
+		defaultConfig.PreallocateSegments = recycle
+		defaultConfig.RecycleSegments = recycle
+
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 1; i <= 200; i++ {
+			assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+			clock.Advance(time.Second)
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+
+		segmentFiles, err := faultFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+		assert.NoError(t, err)
+		assert.Len(t, segmentFiles, 5)
+
+		var previous *wal.SegmentFooter
+		for _, segmentFile := range segmentFiles[:len(segmentFiles)-1] {
+			footer, err := wal.VerifySegment(faultFS, segmentFile)
+			if !assert.NoError(t, err, "Failed to verify %s", segmentFile) {
+				continue
+			}
+			assert.Equal(t, footer.LastLSN-footer.FirstLSN+1, footer.RecordCount)
+			assert.Equal(t, start.Add(time.Duration(footer.FirstLSN-1)*time.Second).UnixNano(), footer.MinTimestamp)
+			assert.Equal(t, start.Add(time.Duration(footer.LastLSN-1)*time.Second).UnixNano(), footer.MaxTimestamp)
+			assert.Greater(t, footer.PayloadBytes, uint64(0))
+			assert.LessOrEqual(t, footer.DataSize, defaultConfig.MaxFileSize)
+			if previous != nil {
+				assert.Equal(t, previous.LastLSN+1, footer.FirstLSN, "Segments must be contiguous")
+			}
+			previous = footer
+		}
+
+		// The current segment is not sealed yet
+		_, err = wal.ReadSegmentFooter(faultFS, segmentFiles[len(segmentFiles)-1])
+		assert.ErrorIs(t, err, wal.ErrNoFooter)
+
+		// A damaged footer is corruption, not a segment that was never sealed
+		footer, err := wal.ReadSegmentFooter(faultFS, segmentFiles[1])
+		assert.NoError(t, err)
+		assert.NoError(t, faultFS.Corrupt(segmentFiles[1], footer.DataSize+4+8, 1))
+		_, err = wal.VerifySegment(faultFS, segmentFiles[1])
+		assert.ErrorIs(t, err, wal.ErrCorruptFooter)
+		assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+
+		// The footer checksum covers every byte of the records
+		assert.NoError(t, faultFS.Corrupt(segmentFiles[0], 10, 1))
+		_, err = wal.VerifySegment(faultFS, segmentFiles[0])
+		assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+	}
+}
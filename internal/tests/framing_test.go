@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func framedRecord(i int, size int) []byte {
+	prefix := fmt.Sprintf("record-%d-", i)
+	return append([]byte(prefix), bytes.Repeat([]byte{byte('a' + i%26)}, size-len(prefix))...)
+}
+
+func Test_BlockFraming(t *testing.T) {
+	fs := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = fs
+	defaultConfig.MaxFileSize = 256 * 1024
+
+	// Segments keep the framing they were started with
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 10; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, 100)), "Failed to write record")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Records larger than a block are split into several fragments
+	sizes := []int{100, 40 * 1024, 32*1024 - 20, 100 * 1024, 20, 5000}
+	defaultConfig.Framing = wal.FramingBlocks
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 11; i <= 60; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, sizes[i%len(sizes)])), "Failed to write record")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	if assert.Len(t, records, 60) {
+		for i, record := range records {
+			size := 100
+			if i >= 10 {
+				size = sizes[(i+1)%len(sizes)]
+			}
+			assert.Equal(t, framedRecord(i+1, size), record.GetData())
+		}
+	}
+	record, err := walog.ReadAt(42)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, framedRecord(42, sizes[42%len(sizes)]), record.GetData())
+
+	segmentFiles, err := fs.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	assert.Greater(t, len(segmentFiles), 2)
+	for _, segmentFile := range segmentFiles[:len(segmentFiles)-1] {
+		_, err := wal.VerifySegment(fs, segmentFile)
+		assert.NoError(t, err, "Failed to verify %s", segmentFile)
+	}
+}
+
+func Test_SalvageRecords(t *testing.T) {
+	for _, framing := range []wal.Framing{wal.FramingBlocks, wal.FramingLengthPrefix} {
+		faultFS := wal.NewFaultFS(wal.NewMemFS())
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = faultFS
+		defaultConfig.Framing = framing
+
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 1; i <= 200; i++ {
+			assert.NoError(t, walog.WriteRecord(framedRecord(i, 1000)), "Failed to write record")
+		}
+		assert.NoError(t, walog.Sync(), "Failed to sync")
+
+		// Damage a few records in the middle of the third block
+		assert.NoError(t, faultFS.Corrupt("/wal/"+wal.SegmentPrefix+"1.log", 2*32*1024+100, 1500))
+		_, err = walog.ReadAllSegments()
+		assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+
+		records, lost, err := walog.SalvageRecords()
+		assert.NoError(t, err, "Failed to salvage records")
+		if !assert.Len(t, lost, 1) {
+			continue
+		}
+		assert.ErrorIs(t, lost[0].Err, wal.ErrCorruptRecord)
+		assert.Equal(t, 200, len(records)+int(lost[0].LastLSN-lost[0].FirstLSN+1))
+		expected := uint64(1)
+		for _, record := range records {
+			if expected == lost[0].FirstLSN {
+				expected = lost[0].LastLSN + 1
+			}
+			assert.Equal(t, expected, record.GetLogSequenceNumber())
+			assert.Equal(t, framedRecord(int(expected), 1000), record.GetData())
+			expected++
+		}
+
+		if framing == wal.FramingBlocks {
+			// Only the records touching the damage and the rest of its block are lost
+			assert.LessOrEqual(t, lost[0].LastLSN-lost[0].FirstLSN+1, uint64(34))
+			assert.Equal(t, uint64(200), records[len(records)-1].GetLogSequenceNumber())
+		} else {
+			// Without blocks the rest of the segment is lost
+			assert.Equal(t, uint64(200), lost[0].LastLSN)
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+}
+
+func Test_BlockFramingRestartKeepsIntactBlocks(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.Framing = wal.FramingBlocks
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 200; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, 1000)), "Failed to write record")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Damage in the third block is no torn tail, the blocks behind it survive
+	// the restart
+	assert.NoError(t, faultFS.Corrupt("/wal/"+wal.SegmentPrefix+"1.log", 2*32*1024+100, 1500))
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	record, err := walog.ReadAt(200)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, framedRecord(200, 1000), record.GetData())
+	assert.NoError(t, walog.WriteRecord(framedRecord(201, 1000)), "Failed to write record")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	defer walog.Close()
+	records, lost, err := walog.SalvageRecords()
+	assert.NoError(t, err, "Failed to salvage records")
+	if assert.Len(t, lost, 1) {
+		assert.LessOrEqual(t, lost[0].LastLSN-lost[0].FirstLSN+1, uint64(34))
+		assert.Equal(t, 201, len(records)+int(lost[0].LastLSN-lost[0].FirstLSN+1))
+	}
+	for _, lsn := range []uint64{1, 150, 201} {
+		record, err := walog.ReadAt(lsn)
+		assert.NoError(t, err, "Failed to read record")
+		assert.Equal(t, framedRecord(int(lsn), 1000), record.GetData())
+	}
+	_, err = walog.ReadAt(70)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+}
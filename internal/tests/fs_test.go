@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestRecords(t *testing.T, walog *wal.WriteAheadLog, count int) {
+	for i := 0; i < count; i++ {
+		marshaledData, err := json.Marshal(TestRecord{Op: 1, Key: fmt.Sprintf("key%d", i+1), Value: fmt.Sprintf("value%d", i+1)})
+		assert.NoError(t, err, "Failed to marshal record")
+		assert.NoError(t, walog.WriteRecord(marshaledData), "Failed to write record")
+	}
+}
+
+func Test_MemFSWriteAndRecover(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 10)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	writeTestRecords(t, walog, 5)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 15)
+	assert.Equal(t, uint64(15), records[len(records)-1].GetLogSequenceNumber())
+}
+
+func Test_MemFSCrashDropsUnsyncedData(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.SyncInterval = 60 * 1000 // Keep the background sync out of the way
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 3)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	writeTestRecords(t, walog, 3)
+
+	// The second batch is still in the buffer, a crash must lose it
+	memFS.Crash()
+	assert.ErrorIs(t, walog.Close(), wal.ErrCrashed)
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to recover logger")
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 3)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_FaultFSInjectedErrors(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 3)
+
+	faultFS.Inject(wal.Fault{Op: wal.FaultOpSync, Path: wal.SegmentPrefix})
+	assert.ErrorIs(t, walog.Sync(), wal.ErrInjectedFault)
+	assert.Equal(t, 1, faultFS.Triggered())
+
+	// Faults fire once unless they are sticky, but a failed sync stays failed
+	assert.NoError(t, walog.WriteRecord([]byte("after the fault")), "Failed to write record")
+	assert.ErrorIs(t, walog.Close(), wal.ErrInjectedFault)
+	assert.Equal(t, 1, faultFS.Triggered())
+
+	segmentPath := filepath.Join("/wal", wal.SegmentPrefix+"1.log")
+	assert.NoError(t, faultFS.Corrupt(segmentPath, 0, 4), "Failed to corrupt segment")
+
+	records, err := walog.ReadAllSegments()
+	assert.Error(t, err, "Reading a corrupted record length must fail")
+	assert.Empty(t, records)
+}
+
+func Test_FaultFSShortWrite(t *testing.T) {
+	memFS := wal.NewMemFS()
+	faultFS := wal.NewFaultFS(memFS)
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 3)
+
+	faultFS.Inject(wal.Fault{Op: wal.FaultOpWrite, ShortWrite: 10})
+	assert.ErrorIs(t, walog.Sync(), wal.ErrInjectedFault)
+
+	data, err := memFS.ReadFile(filepath.Join("/wal", wal.SegmentPrefix+"1.log"))
+	assert.NoError(t, err, "Failed to read segment")
+	assert.Len(t, data, 10, "Only the short write must reach the file")
+}
+
+func Test_RotationNeverTruncatesExistingSegment(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 256
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	// A stray file already occupies the next segment slot
+	nextSegmentPath := filepath.Join("/wal", wal.SegmentPrefix+"2.log")
+	assert.NoError(t, memFS.WriteFile(nextSegmentPath, []byte("precious")))
+
+	var writeErr error
+	for i := 0; i < 20 && writeErr == nil; i++ {
+		writeErr = walog.WriteRecord([]byte(fmt.Sprintf("record-%02d", i)))
+	}
+	assert.Error(t, writeErr, "Rotation into an existing segment must fail")
+
+	data, err := memFS.ReadFile(nextSegmentPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "precious", string(data), "Existing segment must be left untouched")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_ZeroMaxSegmentsKeepsEverySegment(t *testing.T) {
+	memFS := wal.NewMemFS()
+	walog, err := wal.StartLogger(&wal.Config{Directory: "/wal", MaxFileSize: 1024, FS: memFS, EnableForceSync: true})
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	writeTestRecords(t, walog, 100)
+	assert.NoError(t, walog.Sync(), "Failed to sync")
+
+	segmentFiles, err := memFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	assert.Greater(t, len(segmentFiles), 1, "WAL rotation did not create multiple segments")
+	assertContiguous(t, walog, 100)
+	record, err := walog.ReadAt(1)
+	assert.NoError(t, err, "The oldest record must be kept")
+	assert.Equal(t, uint64(1), record.GetLogSequenceNumber())
+}
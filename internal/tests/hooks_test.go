@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingHooks struct {
+	wal.NoopHooks
+	lock     sync.Mutex
+	rotated  []wal.SegmentInfo
+	synced   []wal.SegmentInfo
+	deleted  []wal.SegmentInfo
+	nextPath []string
+}
+
+func (hooks *recordingHooks) OnRotate(sealed wal.SegmentInfo, next wal.SegmentInfo) {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	hooks.rotated = append(hooks.rotated, sealed)
+	hooks.nextPath = append(hooks.nextPath, next.Path)
+}
+
+func (hooks *recordingHooks) OnSync(segment wal.SegmentInfo) {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	hooks.synced = append(hooks.synced, segment)
+}
+
+func (hooks *recordingHooks) OnSegmentDeleted(deleted wal.SegmentInfo) {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	hooks.deleted = append(hooks.deleted, deleted)
+}
+
+func Test_LifecycleHooks(t *testing.T) {
+	logDirectory := LogDirectory + "/wal_hooks_test"
+	defer os.RemoveAll(logDirectory) // Clean up after test
+
+	hooks := &recordingHooks{}
+	defaultConfig := wal.CreateDefaultConfig(logDirectory)
+	defaultConfig.MaxFileSize = 1024 * 1
+	defaultConfig.MaxSegments = 3
+	defaultConfig.Hooks = hooks
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	for i := 0; i < 100; i++ {
+		marshaledData, err := json.Marshal(TestRecord{Op: 1, Key: fmt.Sprintf("key%d", i+1), Value: fmt.Sprintf("value%d", i+1)})
+		assert.NoError(t, err, "Failed to marshal record")
+		assert.NoError(t, walog.WriteRecord(marshaledData), "Failed to write record")
+	}
+
+	// Close delivers every pending event before returning
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	assert.NotEmpty(t, hooks.rotated, "Rotation hook was not called")
+	assert.NotEmpty(t, hooks.deleted, "Segment deletion hook was not called")
+	assert.NotEmpty(t, hooks.synced, "Sync hook was not called")
+
+	expectedFirstLSN := uint64(1)
+	for i, sealed := range hooks.rotated {
+		assert.Equal(t, expectedFirstLSN, sealed.FirstLSN, "Sealed segments must cover contiguous LSNs")
+		assert.GreaterOrEqual(t, sealed.LastLSN, sealed.FirstLSN)
+		assert.LessOrEqual(t, sealed.Size, defaultConfig.MaxFileSize)
+		assert.NotEqual(t, sealed.Path, hooks.nextPath[i])
+		expectedFirstLSN = sealed.LastLSN + 1
+	}
+
+	for i, deleted := range hooks.deleted {
+		assert.Equal(t, hooks.rotated[i], deleted, "Segments must be deleted oldest first")
+	}
+
+	lastSync := hooks.synced[len(hooks.synced)-1]
+	assert.Equal(t, uint64(100), lastSync.LastLSN, "Final sync must cover the last record")
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertReadAt(t *testing.T, walog *wal.WriteAheadLog, lsns ...uint64) {
+	for _, lsn := range lsns {
+		record, err := walog.ReadAt(lsn)
+		if assert.NoError(t, err, "Failed to read lsn %d", lsn) {
+			assert.Equal(t, lsn, record.GetLogSequenceNumber())
+			assert.Equal(t, fmt.Sprintf("record-%d", lsn), string(record.GetData()))
+		}
+	}
+}
+
+func Test_ReadAtAndReadRange(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.MaxFileSize = 4096
+	defaultConfig.IndexInterval = 8
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 500; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	// The last records are still buffered
+	assertReadAt(t, walog, 1, 8, 9, 250, 499, 500)
+	_, err = walog.ReadAt(501)
+	assert.ErrorIs(t, err, wal.ErrLSNNotFound)
+
+	records, err := walog.ReadRange(100, 150)
+	assert.NoError(t, err, "Failed to read range")
+	assert.Len(t, records, 51)
+	for i, record := range records {
+		assert.Equal(t, uint64(100+i), record.GetLogSequenceNumber())
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Sealed segments got a sidecar
+	indexFiles, err := faultFS.Glob("/wal/" + wal.IndexPrefix + wal.SegmentPrefix + "*.idx")
+	assert.NoError(t, err)
+	segmentFiles, err := faultFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	assert.Len(t, indexFiles, len(segmentFiles)-1)
+
+	// A damaged sidecar is rebuilt from its segment
+	assert.NoError(t, faultFS.Corrupt(indexFiles[0], 10, 4))
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	assertReadAt(t, walog, 1, 100, 377, 500)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_IteratorAfterRetention(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.MaxSegments = 3
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 300; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	_, err = walog.ReadAt(1)
+	assert.ErrorIs(t, err, wal.ErrLSNNotFound, "Records deleted by retention must not be found")
+
+	// Iterating from a deleted LSN starts at the oldest record left
+	iterator, err := walog.Iterate(1)
+	assert.NoError(t, err, "Failed to create iterator")
+	defer iterator.Close()
+
+	var lsns []uint64
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err, "Failed to iterate") {
+			break
+		}
+		assert.True(t, strings.HasPrefix(string(record.GetData()), "record-"))
+		lsns = append(lsns, record.GetLogSequenceNumber())
+	}
+	assert.NotEmpty(t, lsns)
+	assert.Greater(t, lsns[0], uint64(1))
+	assert.Equal(t, uint64(300), lsns[len(lsns)-1])
+	assert.Equal(t, int(300-lsns[0]+1), len(lsns), "LSNs must be contiguous")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_ReadAllRecordsReadsCurrentSegment(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 1024
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	for i := 1; i <= 50; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, 100)), "Failed to write record")
+	}
+	assert.NoError(t, walog.Sync(), "Failed to sync")
+
+	current, err := walog.ReadAllRecords()
+	assert.NoError(t, err, "Failed to read records")
+	all, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, all, 50)
+	if assert.NotEmpty(t, current) && assert.Less(t, len(current), 50) {
+		assert.Equal(t, all[len(all)-len(current):], current)
+	}
+}
@@ -0,0 +1,269 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mirrorConfigs(count int) ([]*wal.FaultFS, *wal.MirrorConfig) {
+	faultFSs := make([]*wal.FaultFS, count)
+	config := &wal.MirrorConfig{}
+	for i := range faultFSs {
+		faultFSs[i] = wal.NewFaultFS(wal.NewMemFS())
+		mirrorConfig := wal.CreateDefaultConfig(fmt.Sprintf("/wal-%d", i))
+		mirrorConfig.FS = faultFSs[i]
+		mirrorConfig.MaxFileSize = 1024
+		config.Mirrors = append(config.Mirrors, mirrorConfig)
+	}
+	return faultFSs, config
+}
+
+func writeMirroredRecords(t *testing.T, mirrored *wal.MirroredWAL, from int, to int) {
+	for i := from; i <= to; i++ {
+		assert.NoError(t, mirrored.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+}
+
+func Test_MirroredWALFallsBackToIntactCopy(t *testing.T) {
+	faultFSs, config := mirrorConfigs(2)
+	mirrored, err := wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+	writeMirroredRecords(t, mirrored, 1, 200)
+
+	segmentFiles, err := faultFSs[0].Glob("/wal-0/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	footer, err := wal.ReadSegmentFooter(faultFSs[0], segmentFiles[1])
+	assert.NoError(t, err)
+	// Flip bytes of the data of the segment's first record
+	assert.NoError(t, faultFSs[0].Corrupt(segmentFiles[1], 20, 2))
+	_, err = wal.VerifySegment(faultFSs[0], segmentFiles[1])
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+
+	// Reads and scrubs use the intact copy on the other mirror
+	record, err := mirrored.ReadAt(footer.FirstLSN)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, fmt.Sprintf("record-%d", footer.FirstLSN), string(record.GetData()))
+	records, err := mirrored.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 200)
+	assert.NoError(t, mirrored.Scrub(context.Background()))
+
+	// Without an intact copy the corruption surfaces
+	otherFiles, err := faultFSs[1].Glob("/wal-1/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	for _, otherFile := range otherFiles[:len(otherFiles)-1] {
+		assert.NoError(t, faultFSs[1].Corrupt(otherFile, 20, 2))
+	}
+	_, err = mirrored.ReadAt(footer.FirstLSN)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+	assert.ErrorIs(t, mirrored.Scrub(context.Background()), wal.ErrCorruptRecord)
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+}
+
+func Test_MirroredWALQuorumAndRepair(t *testing.T) {
+	faultFSs, config := mirrorConfigs(3)
+	config.WriteQuorum = 2
+	mirrored, err := wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+	writeMirroredRecords(t, mirrored, 1, 50)
+
+	// Losing one disk keeps the quorum, losing two does not
+	faultFSs[2].Inject(wal.Fault{Op: wal.FaultOpSync, Sticky: true})
+	writeMirroredRecords(t, mirrored, 51, 100)
+	health := mirrored.Health()
+	assert.NoError(t, health[0])
+	assert.NoError(t, health[1])
+	assert.ErrorIs(t, health[2], wal.ErrInjectedFault)
+
+	faultFSs[1].Inject(wal.Fault{Op: wal.FaultOpSync, Sticky: true})
+	assert.ErrorIs(t, mirrored.WriteRecord([]byte("lost")), wal.ErrQuorumLost)
+	assert.ErrorIs(t, mirrored.WriteRecord([]byte("lost")), wal.ErrQuorumLost)
+
+	// Repairing rebuilds the mirrors from the healthy one
+	faultFSs[1].Reset()
+	faultFSs[2].Reset()
+	assert.NoError(t, mirrored.Repair(1), "Failed to repair mirror")
+	assert.NoError(t, mirrored.Repair(2), "Failed to repair mirror")
+	assert.Equal(t, []error{nil, nil, nil}, mirrored.Health())
+
+	// The record that lost the quorum still made it to the first mirror
+	writeMirroredRecords(t, mirrored, 102, 150)
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+
+	for _, mirrorConfig := range config.Mirrors {
+		walog, err := wal.StartLogger(mirrorConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		records, err := walog.ReadAllSegments()
+		assert.NoError(t, err, "Failed to read records")
+		if assert.Len(t, records, 150, mirrorConfig.Directory) {
+			assert.Equal(t, "lost", string(records[100].GetData()))
+			assert.Equal(t, "record-150", string(records[149].GetData()))
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+}
+
+func Test_MirroredWALCatchesUpOnStart(t *testing.T) {
+	_, config := mirrorConfigs(2)
+	mirrored, err := wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+	writeMirroredRecords(t, mirrored, 1, 20)
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+
+	// A crash left records on one mirror only
+	walog, err := wal.StartLogger(config.Mirrors[1])
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 21; i <= 30; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	mirrored, err = wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+	writeMirroredRecords(t, mirrored, 31, 40)
+	assert.Equal(t, []error{nil, nil}, mirrored.Health())
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+
+	walog, err = wal.StartLogger(config.Mirrors[0])
+	assert.NoError(t, err, "Failed to start logger")
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	if assert.Len(t, records, 40) {
+		for i, record := range records {
+			assert.Equal(t, fmt.Sprintf("record-%d", i+1), string(record.GetData()))
+		}
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	_, err = wal.StartMirroredLogger(&wal.MirrorConfig{Mirrors: config.Mirrors[:1]})
+	assert.Error(t, err)
+}
+
+func Test_MirroredWALDivergedOnStart(t *testing.T) {
+	_, config := mirrorConfigs(2)
+	for i, mirrorConfig := range config.Mirrors {
+		walog, err := wal.StartLogger(mirrorConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for j := 1; j <= 20+5*i; j++ {
+			data := fmt.Sprintf("record-%d", j)
+			if i == 1 && j == 10 {
+				data = "diverged"
+			}
+			assert.NoError(t, walog.WriteRecord([]byte(data)), "Failed to write record")
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+
+	// The mirror that is behind has another record at lsn 10
+	mirrored, err := wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+	health := mirrored.Health()
+	assert.Error(t, health[0])
+	assert.NoError(t, health[1])
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+}
+
+func Test_MirroredWALFailsMirrorAfterContextEnds(t *testing.T) {
+	faultFSs, config := mirrorConfigs(2)
+	config.WriteQuorum = 1
+	mirrored, err := wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+
+	// The caller gives up on every write before a mirror got to it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	faultFSs[1].Inject(wal.Fault{Op: wal.FaultOpOpen})
+	for i := 1; i <= 60; i++ {
+		err := mirrored.WriteRecordContext(ctx, []byte(fmt.Sprintf("record-%d", i)))
+		if err != nil {
+			assert.ErrorIs(t, err, context.Canceled)
+		}
+	}
+	// Depending on which write is found out first, the mirror failed on the
+	// fault or on the LSNs that shifted behind it
+	assert.Eventually(t, func() bool { return mirrored.Health()[1] != nil }, 5*time.Second, time.Millisecond)
+	assert.NoError(t, mirrored.Health()[0])
+	assert.NoError(t, mirrored.Sync(), "Failed to sync")
+
+	records, err := mirrored.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	if assert.Len(t, records, 60) {
+		for i, record := range records {
+			assert.Equal(t, fmt.Sprintf("record-%d", i+1), string(record.GetData()))
+		}
+	}
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+}
+
+func Test_RebuildMirrorDetectsNaming(t *testing.T) {
+	fs := wal.NewMemFS()
+	source := wal.CreateDefaultConfig("/source")
+	source.FS = fs
+	source.MaxFileSize = 1024
+	source.SegmentNaming = wal.SegmentNamingBaseLSN
+	walog, err := wal.StartLogger(source)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 50)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// A source without segments is refused instead of emptying the target
+	empty := wal.CreateDefaultConfig("/empty")
+	empty.FS = fs
+	target := wal.CreateDefaultConfig("/target")
+	target.FS = fs
+	assert.Error(t, wal.RebuildMirror(empty, target))
+
+	naming, err := wal.DetectSegmentNaming(fs, "/empty")
+	assert.NoError(t, err)
+	assert.Equal(t, wal.SegmentNamingCounter, naming)
+	naming, err = wal.DetectSegmentNaming(fs, "/source")
+	assert.NoError(t, err)
+	assert.Equal(t, wal.SegmentNamingBaseLSN, naming)
+
+	target.SegmentNaming = naming
+	assert.NoError(t, wal.RebuildMirror(source, target), "Failed to rebuild mirror")
+	walog, err = wal.StartLogger(target)
+	assert.NoError(t, err, "Failed to start rebuilt logger")
+	defer walog.Close()
+	assertContiguous(t, walog, 50)
+}
+
+func Test_RepairMirrorWithBlobs(t *testing.T) {
+	faultFSs, config := mirrorConfigs(2)
+	config.WriteQuorum = 1
+	for _, mirrorConfig := range config.Mirrors {
+		mirrorConfig.BlobThreshold = 100
+	}
+	mirrored, err := wal.StartMirroredLogger(config)
+	assert.NoError(t, err, "Failed to start mirrored logger")
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, mirrored.WriteRecord(framedRecord(i, 500)), "Failed to write record")
+	}
+
+	// The failed mirror keeps blob files the repaired copy must not point into
+	faultFSs[1].Inject(wal.Fault{Op: wal.FaultOpSync, Sticky: true})
+	for i := 6; i <= 20; i++ {
+		assert.NoError(t, mirrored.WriteRecord(framedRecord(i, 500)), "Failed to write record")
+	}
+	faultFSs[1].Reset()
+	assert.NoError(t, mirrored.Repair(1), "Failed to repair mirror")
+	assert.NoError(t, mirrored.Close(), "Failed to close mirrored logger")
+
+	for _, mirrorConfig := range config.Mirrors {
+		walog, err := wal.StartLogger(mirrorConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		records, err := walog.ReadAllSegments()
+		assert.NoError(t, err, "Failed to read records")
+		if assert.Len(t, records, 20, mirrorConfig.Directory) {
+			for i, record := range records {
+				assert.Equal(t, framedRecord(i+1, 500), record.GetData())
+			}
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// segmentBaseLSNs returns the base LSN each segment file is named after.
+func segmentBaseLSNs(t *testing.T, fs wal.FS) []uint64 {
+	files, err := fs.Glob("/wal/*.log")
+	assert.NoError(t, err)
+	assert.True(t, slices.IsSorted(files), "Glob must return files sorted by name")
+
+	var baseLSNs []uint64
+	for _, file := range files {
+		var baseLSN uint64
+		_, err := fmt.Sscanf(filepath.Base(file), "%020d.log", &baseLSN)
+		assert.NoError(t, err, "Segment %s is not named after its base LSN", file)
+		assert.Len(t, filepath.Base(file), 24)
+		baseLSNs = append(baseLSNs, baseLSN)
+	}
+	return baseLSNs
+}
+
+func Test_BaseLSNSegmentNaming(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.SegmentNaming = wal.SegmentNamingBaseLSN
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 200)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	baseLSNs := segmentBaseLSNs(t, memFS)
+	assert.Greater(t, len(baseLSNs), 1, "WAL rotation did not create multiple segments")
+	assert.Equal(t, uint64(1), baseLSNs[0])
+
+	// Every segment starts with the record it is named after
+	for i, baseLSN := range baseLSNs {
+		record, err := walog.ReadAt(baseLSN)
+		assert.NoError(t, err, "Failed to read base LSN %d", baseLSN)
+		if i > 0 {
+			_, err := walog.ReadAt(baseLSN - 1)
+			assert.NoError(t, err, "Records must not be missing between segments")
+		}
+		assert.Equal(t, baseLSN, record.GetLogSequenceNumber())
+	}
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	writeTestRecords(t, walog, 10)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assertContiguous(t, walog, 210)
+}
+
+func Test_MigrateSegmentNames(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 1024
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 100)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Starting with base LSN names migrates the existing segments
+	defaultConfig.SegmentNaming = wal.SegmentNamingBaseLSN
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger with base LSN names")
+
+	oldFiles, err := memFS.Glob("/wal/" + wal.SegmentPrefix + "*")
+	assert.NoError(t, err)
+	assert.Empty(t, oldFiles, "All segments and indexes must have been migrated")
+	assert.Equal(t, uint64(1), segmentBaseLSNs(t, memFS)[0])
+
+	writeTestRecords(t, walog, 100)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assertContiguous(t, walog, 200)
+	assert.NoError(t, wal.MigrateSegmentNames(memFS, "/wal"), "Migrating again must be a no-op")
+}
+
+func Test_CrashConsistencyWithBaseLSNNaming(t *testing.T) {
+	for _, seed := range []int64{1, 2} {
+		harness := NewCrashHarness(seed)
+		harness.Config.SegmentNaming = wal.SegmentNamingBaseLSN
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RecordsLargerThanSegment(t *testing.T) {
+	sizes := []int{100, 5000, 300, 2500, 900, 12000}
+	for _, framing := range []wal.Framing{wal.FramingLengthPrefix, wal.FramingBlocks} {
+		fs := wal.NewMemFS()
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = fs
+		defaultConfig.MaxFileSize = 1024
+		defaultConfig.MaxSegments = 1000
+		defaultConfig.Framing = framing
+		defaultConfig.HashChain = true
+
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 1; i <= 30; i++ {
+			assert.NoError(t, walog.WriteRecord(framedRecord(i, sizes[i%len(sizes)])), "Failed to write record")
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+
+		// Segments never grow past the limit, however large the records
+		segmentFiles, err := fs.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+		assert.NoError(t, err)
+		for _, segmentFile := range segmentFiles {
+			fileInfo, err := fs.Stat(segmentFile)
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, fileInfo.Size(), defaultConfig.MaxFileSize, "Segment %s is too large", segmentFile)
+		}
+
+		walog, err = wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		records, err := walog.ReadAllSegments()
+		assert.NoError(t, err, "Failed to read records")
+		if assert.Len(t, records, 30) {
+			for i, record := range records {
+				assert.Equal(t, uint64(i+1), record.GetLogSequenceNumber())
+				assert.Equal(t, framedRecord(i+1, sizes[(i+1)%len(sizes)]), record.GetData())
+			}
+		}
+
+		record, err := walog.ReadAt(11)
+		assert.NoError(t, err, "Failed to read record")
+		assert.Equal(t, framedRecord(11, sizes[11%len(sizes)]), record.GetData())
+
+		newest, err := walog.LastRecords(7)
+		assert.NoError(t, err, "Failed to read records backwards")
+		if assert.Len(t, newest, 7) {
+			for i, record := range newest {
+				assert.Equal(t, framedRecord(30-i, sizes[(30-i)%len(sizes)]), record.GetData())
+			}
+		}
+		assert.NoError(t, walog.VerifyChain(1, math.MaxUint64), "Hash chain broke across parts")
+
+		// Records written after a split one share its last segment
+		assert.NoError(t, walog.WriteRecord(framedRecord(31, 50)), "Failed to write record")
+		records, err = walog.ReadRange(29, 31)
+		assert.NoError(t, err, "Failed to read records")
+		assert.Len(t, records, 3)
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+}
+
+func Test_IncompleteRecordAfterCrash(t *testing.T) {
+	fs := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = fs
+	defaultConfig.MaxFileSize = 1024
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, 100)), "Failed to write record")
+	}
+	assert.NoError(t, walog.WriteRecord(framedRecord(4, 4000)), "Failed to write record")
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// Lose the segment with the last part, as if the crash hit while writing it
+	segmentFiles, err := fs.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	assert.Greater(t, len(segmentFiles), 3)
+	assert.NoError(t, fs.Remove(fmt.Sprintf("/wal/%s%d.log", wal.SegmentPrefix, len(segmentFiles))))
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 3)
+
+	// The incomplete record keeps its LSN, readers skip it
+	assert.NoError(t, walog.WriteRecord(framedRecord(5, 3000)), "Failed to write record")
+	assert.NoError(t, walog.WriteRecord(framedRecord(6, 100)), "Failed to write record")
+	_, err = walog.ReadAt(4)
+	assert.ErrorIs(t, err, wal.ErrLSNNotFound)
+	record, err := walog.ReadAt(5)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, framedRecord(5, 3000), record.GetData())
+
+	records, err = walog.ReadRange(1, 6)
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 5)
+	newest, err := walog.LastRecords(10)
+	assert.NoError(t, err, "Failed to read records backwards")
+	if assert.Len(t, newest, 5) {
+		assert.Equal(t, uint64(5), newest[1].GetLogSequenceNumber())
+		assert.Equal(t, uint64(3), newest[2].GetLogSequenceNumber())
+	}
+}
@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertContiguous(t *testing.T, walog *wal.WriteAheadLog, lastLSN uint64) {
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.NotEmpty(t, records)
+	for i, record := range records {
+		assert.Equal(t, records[0].GetLogSequenceNumber()+uint64(i), record.GetLogSequenceNumber(), "LSNs must be contiguous")
+	}
+	assert.Equal(t, lastLSN, records[len(records)-1].GetLogSequenceNumber())
+}
+
+func Test_PreallocatedSegments(t *testing.T) {
+	memFS := wal.NewMemFS()
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.PreallocateSegments = true
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 50)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	files, err := memFS.Glob("/wal/" + wal.SegmentPrefix + "*")
+	assert.NoError(t, err)
+	assert.Greater(t, len(files), 1, "WAL rotation did not create multiple segments")
+	for _, file := range files {
+		fileInfo, err := memFS.Stat(file)
+		assert.NoError(t, err)
+		assert.Equal(t, defaultConfig.MaxFileSize, fileInfo.Size(), "Segment %s was not preallocated", file)
+	}
+
+	// Reopening must find the end of the records, not the end of the file
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	writeTestRecords(t, walog, 10)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assertContiguous(t, walog, 60)
+}
+
+func Test_RecycledSegments(t *testing.T) {
+	memFS := wal.NewMemFS()
+	hooks := &recordingHooks{}
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = memFS
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.MaxSegments = 3
+	defaultConfig.PreallocateSegments = true
+	defaultConfig.RecycleSegments = true
+	defaultConfig.Hooks = hooks
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	writeTestRecords(t, walog, 100)
+
+	// Stale records of recycled segments must never show up, not even in the
+	// segment that is still being written
+	assert.NoError(t, walog.Sync())
+	assertContiguous(t, walog, 100)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	files, err := memFS.Glob("/wal/" + wal.SegmentPrefix + "*")
+	assert.NoError(t, err)
+	assert.Len(t, files, defaultConfig.MaxSegments)
+	assert.NotEmpty(t, hooks.deleted, "Recycled segments must be reported as deleted")
+
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	writeTestRecords(t, walog, 30)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assertContiguous(t, walog, 130)
+}
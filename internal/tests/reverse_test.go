@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IterateReverse(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 4096
+	defaultConfig.IndexInterval = 8
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+
+	records, err := walog.LastRecords(10)
+	assert.NoError(t, err, "Failed to read an empty WAL")
+	assert.Empty(t, records)
+
+	for i := 1; i <= 500; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	for _, from := range []uint64{math.MaxUint64, 500, 250, 8, 1} {
+		iterator, err := walog.IterateReverse(from)
+		assert.NoError(t, err, "Failed to create reverse iterator")
+		expected := min(from, 500)
+		for {
+			record, err := iterator.Next()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err, "Failed to iterate backwards from %d", from) {
+				break
+			}
+			assert.Equal(t, expected, record.GetLogSequenceNumber())
+			assert.Equal(t, fmt.Sprintf("record-%d", expected), string(record.GetData()))
+			expected--
+		}
+		assert.Equal(t, uint64(0), expected, "Iterating backwards from %d must reach the first record", from)
+		assert.NoError(t, iterator.Close())
+	}
+
+	records, err = walog.LastRecords(3)
+	assert.NoError(t, err, "Failed to read the last records")
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, uint64(500), records[0].GetLogSequenceNumber())
+		assert.Equal(t, uint64(498), records[2].GetLogSequenceNumber())
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_IterateReverseAfterRetention(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.MaxSegments = 3
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 300; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	// Walking backwards stops at the oldest record left
+	records, err := walog.LastRecords(300)
+	assert.NoError(t, err, "Failed to read the last records")
+	assert.NotEmpty(t, records)
+	assert.Less(t, len(records), 300)
+	for i, record := range records {
+		assert.Equal(t, uint64(300-i), record.GetLogSequenceNumber())
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
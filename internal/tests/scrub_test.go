@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type corruptionHooks struct {
+	wal.NoopHooks
+	lock    sync.Mutex
+	corrupt []string
+}
+
+func (hooks *corruptionHooks) OnCorruption(segment wal.SegmentInfo, err error) {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	hooks.corrupt = append(hooks.corrupt, segment.Path)
+}
+
+func (hooks *corruptionHooks) reported() []string {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	return append([]string(nil), hooks.corrupt...)
+}
+
+func Test_Scrub(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	clock := wal.NewFakeClock(time.Now())
+	hooks := &corruptionHooks{}
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.Clock = clock
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.Hooks = hooks
+	defaultConfig.ScrubInterval = time.Hour
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 300; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	segmentFiles, err := faultFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+	assert.NoError(t, err)
+	sealedCount := uint64(len(segmentFiles) - 1)
+
+	// The background scrubber runs once per interval
+	clock.Advance(time.Hour)
+	assert.Eventually(t, func() bool { return walog.ScrubStats().Passes == 1 }, 5*time.Second, time.Millisecond)
+	stats := walog.ScrubStats()
+	assert.Equal(t, sealedCount, stats.SegmentsScrubbed)
+	assert.Equal(t, uint64(0), stats.CorruptSegments)
+	assert.Greater(t, stats.BytesScrubbed, uint64(0))
+
+	// Bit rot in a sealed segment is reported
+	assert.NoError(t, faultFS.Corrupt(segmentFiles[1], 100, 2))
+	err = walog.Scrub(context.Background())
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+	stats = walog.ScrubStats()
+	assert.Equal(t, uint64(2), stats.Passes)
+	assert.Equal(t, uint64(1), stats.CorruptSegments)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, walog.Scrub(ctx), context.Canceled)
+
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+	assert.Equal(t, []string{segmentFiles[1]}, hooks.reported())
+}
+
+func Test_ScrubRate(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.ScrubRate = 32 * 1024
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	for i := 1; i <= 1000; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+	}
+
+	start := time.Now()
+	assert.NoError(t, walog.Scrub(context.Background()), "Failed to scrub")
+	elapsed := time.Since(start)
+
+	scrubbed := walog.ScrubStats().BytesScrubbed
+	expected := time.Duration(float64(scrubbed) / float64(defaultConfig.ScrubRate) * float64(time.Second))
+	assert.GreaterOrEqual(t, elapsed, expected*9/10, "Scrubbing %d bytes was not throttled", scrubbed)
+}
+
+// plainHooks implements Hooks only, like implementations written before the
+// scrubber existed.
+type plainHooks struct{}
+
+func (plainHooks) OnRotate(sealed wal.SegmentInfo, next wal.SegmentInfo) {}
+func (plainHooks) OnSync(segment wal.SegmentInfo)                        {}
+func (plainHooks) OnSegmentDeleted(deleted wal.SegmentInfo)              {}
+
+func Test_ScrubBlobs(t *testing.T) {
+	faultFS := wal.NewFaultFS(wal.NewMemFS())
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = faultFS
+	defaultConfig.MaxFileSize = 4096
+	defaultConfig.MaxSegments = 1000
+	defaultConfig.BlobThreshold = 512
+	defaultConfig.Hooks = plainHooks{}
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	for i := 1; i <= 100; i++ {
+		assert.NoError(t, walog.WriteRecord(framedRecord(i, blobRecordSize(i))), "Failed to write record")
+	}
+	assert.NoError(t, walog.Scrub(context.Background()), "Failed to scrub")
+	assert.Greater(t, walog.ScrubStats().BytesScrubbed, uint64(6000), "Blobs were not scrubbed")
+
+	// Bit rot in a blob is found through the segment pointing to it
+	blobFiles, err := faultFS.Glob("/wal/" + wal.BlobPrefix + "*.blob")
+	assert.NoError(t, err)
+	assert.NoError(t, faultFS.Corrupt(blobFiles[0], 3000, 1))
+	assert.ErrorIs(t, walog.Scrub(context.Background()), wal.ErrCorruptRecord)
+	assert.Equal(t, uint64(1), walog.ScrubStats().CorruptSegments)
+}
+
+func Test_ScrubFooter(t *testing.T) {
+	// A bit flip in the magic makes the footer look missing, in the rest it
+	// fails its checksum
+	for _, footerOffset := range []int64{0, 8} {
+		faultFS := wal.NewFaultFS(wal.NewMemFS())
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = faultFS
+		defaultConfig.MaxFileSize = 1024
+
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		for i := 1; i <= 300; i++ {
+			assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+		}
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+
+		segmentFiles, err := faultFS.Glob("/wal/" + wal.SegmentPrefix + "*.log")
+		assert.NoError(t, err)
+		footer, err := wal.ReadSegmentFooter(faultFS, segmentFiles[1])
+		assert.NoError(t, err)
+		assert.NoError(t, faultFS.Corrupt(segmentFiles[1], footer.DataSize+4+footerOffset, 1))
+
+		// The sidecar remembers the segment was sealed with a footer
+		walog, err = wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to restart logger")
+		assert.ErrorIs(t, walog.Scrub(context.Background()), wal.ErrCorruptRecord)
+		assert.Equal(t, uint64(1), walog.ScrubStats().CorruptSegments)
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WriteRecordFrom(t *testing.T) {
+	payload := make([]byte, 3*1024*1024+123)
+	for i := range payload {
+		payload[i] = byte(i * 7 % 251)
+	}
+	for _, framing := range []wal.Framing{wal.FramingLengthPrefix, wal.FramingBlocks} {
+		fs := wal.NewMemFS()
+		defaultConfig := wal.CreateDefaultConfig("/wal")
+		defaultConfig.FS = fs
+		defaultConfig.MaxFileSize = 1024 * 1024
+		defaultConfig.Framing = framing
+		defaultConfig.HashChain = true
+
+		walog, err := wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		assert.NoError(t, walog.WriteRecord(framedRecord(1, 100)), "Failed to write record")
+		assert.NoError(t, walog.WriteRecordFrom(bytes.NewReader(payload), int64(len(payload))), "Failed to write record")
+		assert.NoError(t, walog.WriteRecordFrom(bytes.NewReader(nil), 0), "Failed to write empty record")
+		assert.NoError(t, walog.WriteRecord(framedRecord(4, 100)), "Failed to write record")
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+
+		walog, err = wal.StartLogger(defaultConfig)
+		assert.NoError(t, err, "Failed to start logger")
+		reader, err := walog.OpenRecord(2)
+		if assert.NoError(t, err, "Failed to open record") {
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err, "Failed to read record")
+			assert.True(t, bytes.Equal(payload, data), "Streamed record differs")
+			assert.Equal(t, uint64(2), reader.LogSequenceNumber())
+			assert.NoError(t, reader.Close())
+		}
+		reader, err = walog.OpenRecord(3)
+		if assert.NoError(t, err, "Failed to open record") {
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err, "Failed to read record")
+			assert.Empty(t, data)
+			assert.NoError(t, reader.Close())
+		}
+		_, err = walog.OpenRecord(5)
+		assert.ErrorIs(t, err, wal.ErrLSNNotFound)
+
+		records, err := walog.ReadAllSegments()
+		assert.NoError(t, err, "Failed to read records")
+		if assert.Len(t, records, 4) {
+			assert.True(t, bytes.Equal(payload, records[1].GetData()), "Joined record differs")
+		}
+		newest, err := walog.LastRecords(4)
+		assert.NoError(t, err, "Failed to read records backwards")
+		assert.Len(t, newest, 4)
+		assert.NoError(t, walog.VerifyChain(1, math.MaxUint64), "Hash chain broke across streamed parts")
+		assert.NoError(t, walog.Close(), "Failed to close logger")
+	}
+}
+
+func Test_WriteRecordFromShortReader(t *testing.T) {
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	assert.NoError(t, walog.WriteRecord(framedRecord(1, 100)), "Failed to write record")
+
+	// The reader ends after some parts were written, which uses up the LSN
+	err = walog.WriteRecordFrom(bytes.NewReader(make([]byte, 600*1024)), 1024*1024)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.NoError(t, walog.WriteRecord(framedRecord(3, 100)), "Failed to write record")
+
+	_, err = walog.ReadAt(2)
+	assert.ErrorIs(t, err, wal.ErrLSNNotFound)
+	reader, err := walog.OpenRecord(2)
+	if assert.NoError(t, err, "Failed to open record") {
+		_, err = io.ReadAll(reader)
+		assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+		assert.NoError(t, reader.Close())
+	}
+	record, err := walog.ReadAt(3)
+	assert.NoError(t, err, "Failed to read record")
+	assert.Equal(t, framedRecord(3, 100), record.GetData())
+}
+
+func Test_OpenCompressedRecord(t *testing.T) {
+	codec, err := wal.NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err, "Failed to create codec")
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.Codec = codec
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	defer walog.Close()
+	// Random letters only compress to half, so the record is still split
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := range data {
+		data[i] = 'a' + data[i]%16
+	}
+	assert.NoError(t, walog.WriteRecord(data), "Failed to write record")
+
+	// Streamed records could not be compressed, so they are refused up front
+	err = walog.WriteRecordFrom(bytes.NewReader(data), int64(len(data)))
+	assert.ErrorIs(t, err, wal.ErrStreamingUnsupported)
+
+	reader, err := walog.OpenRecord(1)
+	if assert.NoError(t, err, "Failed to open record") {
+		read, err := io.ReadAll(reader)
+		assert.NoError(t, err, "Failed to read record")
+		assert.Equal(t, data, read)
+		assert.NoError(t, reader.Close())
+	}
+	_, err = walog.ReadAt(2)
+	assert.ErrorIs(t, err, wal.ErrLSNNotFound, "A refused record must not use up an LSN")
+}
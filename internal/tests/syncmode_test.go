@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"testing"
+	"walstore/internal/wal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var allSyncModes = []wal.SyncMode{wal.SyncModeFsync, wal.SyncModeFdatasync, wal.SyncModeDsync, wal.SyncModeDirect}
+
+func Test_SyncModes(t *testing.T) {
+	for _, syncMode := range allSyncModes {
+		t.Run(syncMode.String(), func(t *testing.T) {
+			if !syncMode.Supported() {
+				t.Skipf("Sync mode %s is not supported on this platform", syncMode)
+			}
+
+			memFS := wal.NewMemFS()
+			defaultConfig := wal.CreateDefaultConfig("/wal")
+			defaultConfig.FS = memFS
+			defaultConfig.MaxFileSize = 8 * 1024
+			defaultConfig.SyncMode = syncMode
+
+			walog, err := wal.StartLogger(defaultConfig)
+			assert.NoError(t, err, "Failed to start logger")
+			writeTestRecords(t, walog, 300)
+			assert.NoError(t, walog.Close(), "Failed to close logger")
+
+			walog, err = wal.StartLogger(defaultConfig)
+			assert.NoError(t, err, "Failed to restart logger")
+			writeTestRecords(t, walog, 50)
+			assert.NoError(t, walog.Sync(), "Failed to sync logger")
+
+			// Everything synced must survive, whichever way it was made durable
+			memFS.Crash()
+			walog, err = wal.StartLogger(defaultConfig)
+			assert.NoError(t, err, "Failed to recover logger")
+			assertContiguous(t, walog, 350)
+			assert.NoError(t, walog.Close(), "Failed to close logger")
+		})
+	}
+}
+
+func Test_CrashConsistencyWithDirectIO(t *testing.T) {
+	if !wal.SyncModeDirect.Supported() {
+		t.Skip("O_DIRECT is not supported on this platform")
+	}
+	for _, seed := range []int64{1, 2} {
+		harness := NewCrashHarness(seed)
+		harness.Config.SyncMode = wal.SyncModeDirect
+		assert.NoError(t, harness.Run(100), "Crash consistency violated with seed %d", seed)
+	}
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"walstore/internal/wal"
+	pb "walstore/proto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FindLSNByTimeAndReplayUntil(t *testing.T) {
+	start := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	clock := wal.NewFakeClock(start)
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.Clock = clock
+	defaultConfig.MaxFileSize = 2048
+	defaultConfig.IndexInterval = 4
+
+	// Record i is written i-1 seconds after start
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	for i := 1; i <= 200; i++ {
+		assert.NoError(t, walog.WriteRecord([]byte(fmt.Sprintf("record-%d", i))), "Failed to write record")
+		clock.Advance(time.Second)
+	}
+
+	assertFindLSNByTime := func(walog *wal.WriteAheadLog) {
+		for _, seconds := range []int{0, 3, 64, 127, 199, 500} {
+			lsn, err := walog.FindLSNByTime(start.Add(time.Duration(seconds)*time.Second + 500*time.Millisecond))
+			assert.NoError(t, err, "Failed to find lsn at %ds", seconds)
+			assert.Equal(t, uint64(min(seconds+1, 200)), lsn)
+		}
+
+		_, err := walog.FindLSNByTime(start.Add(-time.Second))
+		assert.ErrorIs(t, err, wal.ErrLSNNotFound, "No record is older than the first one")
+	}
+	assertFindLSNByTime(walog)
+
+	var replayed []*pb.WalRecord
+	err = walog.ReplayUntil(start.Add(90*time.Second), func(record *pb.WalRecord) error {
+		replayed = append(replayed, record)
+		return nil
+	})
+	assert.NoError(t, err, "Failed to replay")
+	assert.Len(t, replayed, 91)
+	for i, record := range replayed {
+		assert.Equal(t, uint64(i+1), record.GetLogSequenceNumber())
+	}
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// The time index survives a restart through the sidecars
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	assertFindLSNByTime(walog)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
+
+func Test_MonotonicTimestamps(t *testing.T) {
+	start := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	clock := wal.NewFakeClock(start)
+	defaultConfig := wal.CreateDefaultConfig("/wal")
+	defaultConfig.FS = wal.NewMemFS()
+	defaultConfig.Clock = clock
+	defaultConfig.MaxFileSize = 1024
+	defaultConfig.MonotonicTimestamps = true
+
+	walog, err := wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to start logger")
+	write := func(count int) {
+		for i := 0; i < count; i++ {
+			assert.NoError(t, walog.WriteRecord([]byte("record")), "Failed to write record")
+		}
+	}
+
+	// A frozen clock, then a clock stepped back by NTP
+	write(10)
+	clock.Set(start.Add(-time.Minute))
+	write(10)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+
+	// The last timestamp is restored from the WAL
+	clock.Set(start.Add(-time.Hour))
+	walog, err = wal.StartLogger(defaultConfig)
+	assert.NoError(t, err, "Failed to restart logger")
+	write(10)
+
+	// The logical ticks are dropped once the clock passes them
+	clock.Set(start.Add(time.Hour))
+	write(1)
+	assert.NoError(t, walog.Sync(), "Failed to sync")
+
+	records, err := walog.ReadAllSegments()
+	assert.NoError(t, err, "Failed to read records")
+	assert.Len(t, records, 31)
+	for i := 1; i < len(records); i++ {
+		assert.Greater(t, records[i].GetTimestamp(), records[i-1].GetTimestamp(), "Timestamps must strictly increase")
+	}
+	assert.Equal(t, start.UnixNano(), records[0].GetTimestamp())
+	assert.Equal(t, start.Add(time.Hour).UnixNano(), records[30].GetTimestamp())
+
+	lsn, err := walog.FindLSNByTime(start)
+	assert.NoError(t, err, "Failed to find lsn")
+	assert.Equal(t, uint64(1), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close logger")
+}
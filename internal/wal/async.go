@@ -0,0 +1,149 @@
+package wal
+
+import (
+	"errors"
+)
+
+// ErrLoggerClosed is returned for records appended after Close.
+var ErrLoggerClosed = errors.New("WAL is closed")
+
+const (
+	appendQueueSize = 1024 // Records AppendAsync can queue before it blocks
+	maxAppendBatch  = 256  // Records the writer goroutine writes per lock acquisition
+)
+
+// AppendFuture is the pending result of AppendAsync.
+type AppendFuture struct {
+	data       []byte
+	lsn        uint64
+	err        error
+	written    chan struct{} // Closed once the record is in the WAL buffer or failed
+	durable    chan struct{} // Closed once a sync covered the record or it failed
+	durableErr error
+}
+
+func newAppendFuture(data []byte) *AppendFuture {
+	return &AppendFuture{
+		data:    data,
+		written: make(chan struct{}),
+		durable: make(chan struct{}),
+	}
+}
+
+// Written is closed once Wait would no longer block.
+func (future *AppendFuture) Written() <-chan struct{} {
+	return future.written
+}
+
+// Durable is closed once WaitDurable would no longer block.
+func (future *AppendFuture) Durable() <-chan struct{} {
+	return future.durable
+}
+
+// Wait blocks until the record was written and returns its log sequence number.
+func (future *AppendFuture) Wait() (uint64, error) {
+	<-future.written
+	return future.lsn, future.err
+}
+
+// WaitDurable blocks until a sync covered the record, either the periodic one
+// or an explicit Sync, and returns its log sequence number.
+func (future *AppendFuture) WaitDurable() (uint64, error) {
+	<-future.durable
+	if future.err != nil {
+		return 0, future.err
+	}
+	return future.lsn, future.durableErr
+}
+
+// AppendAsync queues data to be written by the WAL's writer goroutine, which
+// batches records from all callers under a single lock acquisition. data must
+// not be modified until the future is written. It only blocks when the queue
+// is full.
+func (wal *WriteAheadLog) AppendAsync(data []byte) *AppendFuture {
+	future := newAppendFuture(data)
+
+	wal.appendLock.RLock()
+	defer wal.appendLock.RUnlock()
+
+	if wal.appendClosed {
+		future.fail(ErrLoggerClosed)
+		return future
+	}
+	wal.appendQueue <- future
+	return future
+}
+
+// writeAppendedRecords is the writer goroutine. It exits once the queue is
+// closed and drained.
+func (wal *WriteAheadLog) writeAppendedRecords() {
+	defer close(wal.writerDone)
+
+	batch := make([]*AppendFuture, 0, maxAppendBatch)
+	for future := range wal.appendQueue {
+		batch = append(batch[:0], future)
+
+	collect:
+		for len(batch) < maxAppendBatch {
+			select {
+			case future, ok := <-wal.appendQueue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, future)
+			default:
+				break collect
+			}
+		}
+
+		wal.writeBatch(batch)
+	}
+}
+
+func (wal *WriteAheadLog) writeBatch(batch []*AppendFuture) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	for _, future := range batch {
+		lsn, err := wal.appendRecord(future.data)
+		future.data = nil
+		if err != nil {
+			future.fail(err)
+			continue
+		}
+
+		future.lsn = lsn
+		close(future.written)
+		wal.pendingDurable = append(wal.pendingDurable, future)
+	}
+}
+
+// stopAppends rejects further AppendAsync calls and waits until the writer
+// goroutine wrote everything queued so far.
+func (wal *WriteAheadLog) stopAppends() {
+	wal.appendLock.Lock()
+	if !wal.appendClosed {
+		wal.appendClosed = true
+		close(wal.appendQueue)
+	}
+	wal.appendLock.Unlock()
+
+	<-wal.writerDone
+}
+
+// resolveDurable completes the futures waiting for a sync, with the error of
+// the sync that was supposed to cover them. Must be called with wal.lock held.
+func (wal *WriteAheadLog) resolveDurable(err error) {
+	for _, future := range wal.pendingDurable {
+		future.durableErr = err
+		close(future.durable)
+	}
+	clear(wal.pendingDurable)
+	wal.pendingDurable = wal.pendingDurable[:0]
+}
+
+func (future *AppendFuture) fail(err error) {
+	future.err = err
+	close(future.written)
+	close(future.durable)
+}
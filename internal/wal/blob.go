@@ -0,0 +1,279 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	pb "walstore/proto"
+)
+
+// BlobPrefix starts the names of blob files, which end in their base LSN,
+// the LSN of the first record pointing into them, zero padded like base LSN
+// segment names.
+const BlobPrefix = "blob-"
+
+// blobFileName returns the name of the blob file with the given base LSN.
+func blobFileName(baseLSN uint64) string {
+	return fmt.Sprintf("%s%0*d.blob", BlobPrefix, baseLSNDigits, baseLSN)
+}
+
+// listBlobFiles returns the blob files in dir and their base LSNs, oldest
+// first.
+func listBlobFiles(fs FS, dir string) ([]string, []uint64, error) {
+	files, err := fs.Glob(filepath.Join(dir, BlobPrefix+"*.blob"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Names sort by base LSN, as they are zero padded
+	baseLSNs := make([]uint64, len(files))
+	for i, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), BlobPrefix), ".blob")
+		if baseLSNs[i], err = strconv.ParseUint(name, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse base LSN from blob file %s: %w", file, err)
+		}
+	}
+	return files, baseLSNs, nil
+}
+
+// writeBlob appends the stored data of the record with the given LSN to the
+// current blob file and returns where it went.
+func (wal *WriteAheadLog) writeBlob(data []byte, logSeqNumber uint64) (*pb.BlobPointer, error) {
+	if err := wal.startBlob(logSeqNumber, int64(len(data))); err != nil {
+		return nil, err
+	}
+	wal.scratchBlob.File = wal.blobBaseLSN
+	wal.scratchBlob.Offset = wal.blobSize
+	wal.scratchBlob.Length = int64(len(data))
+	wal.scratchBlob.Checksum = crc32.ChecksumIEEE(data)
+	if err := wal.writeBlobData(data); err != nil {
+		wal.discardBlob(wal.scratchBlob.Offset)
+		return nil, err
+	}
+	return &wal.scratchBlob, nil
+}
+
+// startBlob makes room for a blob of size bytes, moving on to a new blob file
+// based at the record's LSN when the current one is full.
+func (wal *WriteAheadLog) startBlob(logSeqNumber uint64, size int64) error {
+	if err := wal.reserveInFlight(size); err != nil {
+		return err
+	}
+	if wal.blobFile != nil && (wal.blobSize == 0 || wal.blobSize+size <= wal.maxFileSize) {
+		return nil
+	}
+
+	// Records pointing into the full blob file may still wait for a sync
+	if wal.blobFile != nil {
+		if err := wal.syncBlobFile(); err != nil {
+			// Sticky like a failed sync, see sync
+			wal.syncErr = err
+			return err
+		}
+		if err := wal.blobFile.Close(); err != nil {
+			return err
+		}
+		wal.blobFile = nil
+	}
+
+	// A blob file based at the LSN being written only holds blobs of records
+	// that never made it, so it can be overwritten
+	var flags int
+	if wal.syncMode.writesAreDurable() {
+		flags = dsyncFlag
+	}
+	blobPath := filepath.Join(wal.directory, blobFileName(logSeqNumber))
+	file, err := wal.fs.OpenFile(blobPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	if err := wal.fs.SyncDir(wal.directory); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+	wal.blobFile = file
+	wal.blobBaseLSN = logSeqNumber
+	wal.blobSize = 0
+	return nil
+}
+
+// writeBlobData appends data to the current blob file.
+func (wal *WriteAheadLog) writeBlobData(data []byte) error {
+	n, err := wal.blobFile.Write(data)
+	wal.blobSize += int64(n)
+	wal.unsyncedBytes += int64(n)
+	wal.blobsUnsynced = true
+	if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	return nil
+}
+
+// discardBlob cuts the current blob file back to offset, where the blob of a
+// record that failed to be written started, so its space is used again.
+func (wal *WriteAheadLog) discardBlob(offset int64) {
+	if err := wal.blobFile.Truncate(offset); err != nil {
+		fmt.Printf("Error discarding WAL blob: %v\n", err)
+	}
+	if _, err := wal.blobFile.Seek(offset, io.SeekStart); err != nil {
+		fmt.Printf("Error discarding WAL blob: %v\n", err)
+		return
+	}
+	wal.blobSize = offset
+}
+
+// syncBlobFile makes the blobs written since the last sync durable, which has
+// to happen before the records pointing to them are.
+func (wal *WriteAheadLog) syncBlobFile() error {
+	if !wal.blobsUnsynced || !wal.shouldForceSync || wal.syncMode.writesAreDurable() {
+		return nil
+	}
+
+	var err error
+	if wal.syncMode == SyncModeFdatasync {
+		err = datasyncFile(wal.blobFile)
+	} else {
+		err = wal.blobFile.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync blob file: %w", err)
+	}
+	wal.blobsUnsynced = false
+	return nil
+}
+
+// collectBlobFiles removes the blob files no record in the WAL points into
+// anymore: those whose records were all deleted by retention, and those based
+// past the last record, which a crash cut off before their records.
+func (wal *WriteAheadLog) collectBlobFiles() error {
+	files, baseLSNs, err := listBlobFiles(wal.fs, wal.directory)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	oldestLSN := wal.lastLogSequenceNumber + 1
+	for _, index := range wal.segments {
+		if !index.empty() {
+			oldestLSN = index.firstLSN
+			break
+		}
+	}
+
+	removed := false
+	for i, file := range files {
+		// A blob file holds the blobs of the records before the next one's base
+		garbage := baseLSNs[i] > wal.lastLogSequenceNumber || (i+1 < len(files) && baseLSNs[i+1] <= oldestLSN)
+		if !garbage || (wal.blobFile != nil && file == wal.blobFile.Name()) {
+			continue
+		}
+		if err := wal.fs.Remove(file); err != nil {
+			return err
+		}
+		removed = true
+	}
+
+	if removed {
+		if err := wal.fs.SyncDir(wal.directory); err != nil {
+			return fmt.Errorf("failed to sync WAL directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// firstLostBlob returns the offset of the first record of a segment, among
+// those in its first size bytes, whose blob is missing or does not match its
+// pointer, along with the reason. It returns size when every blob is intact.
+func firstLostBlob(fs FS, directory string, segmentPath string, size int64) (int64, error) {
+	reader, err := openSegmentReader(fs, segmentPath, 0, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open WAL segment file: %w", err)
+	}
+	defer reader.close()
+
+	for {
+		record, offset, err := reader.next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if errors.Is(err, ErrCorruptRecord) && reader.blocks {
+			// Damage buildSegmentIndex resynced past
+			resynced, err := reader.resync()
+			if err != nil {
+				return 0, err
+			}
+			if !resynced {
+				return size, nil
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		err = readBlob(fs, directory, record)
+		if errors.Is(err, ErrLSNNotFound) {
+			err = fmt.Errorf("%w: %w", ErrCorruptRecord, err)
+		}
+		if err != nil {
+			return offset, err
+		}
+	}
+}
+
+// openBlob opens the blob file a record points to at the start of its data.
+func openBlob(fs FS, directory string, record *pb.WalRecord) (File, error) {
+	blob := record.GetBlob()
+	blobPath := filepath.Join(directory, blobFileName(blob.GetFile()))
+	file, err := fs.OpenFile(blobPath, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: blob file %s was deleted", ErrLSNNotFound, blobPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob file: %w", err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err == nil && (blob.GetOffset() < 0 || blob.GetLength() < 0 || blob.GetOffset()+blob.GetLength() > fileInfo.Size()) {
+		err = fmt.Errorf("%w: blob of lsn %d is past the end of %s", ErrCorruptRecord, record.GetLogSequenceNumber(), blobPath)
+	}
+	if err == nil {
+		_, err = file.Seek(blob.GetOffset(), io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// readBlob replaces the pointer of a record whose data was moved to a blob
+// file by the data, as stored.
+func readBlob(fs FS, directory string, record *pb.WalRecord) error {
+	if record.GetBlob() == nil {
+		return nil
+	}
+
+	file, err := openBlob(fs, directory, record)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data := make([]byte, record.GetBlob().GetLength())
+	if _, err := io.ReadFull(file, data); err != nil {
+		return fmt.Errorf("failed to read blob of lsn %d: %w", record.GetLogSequenceNumber(), err)
+	}
+	if crc32.ChecksumIEEE(data) != record.GetBlob().GetChecksum() {
+		return fmt.Errorf("%w: blob of lsn %d does not match its checksum", ErrCorruptRecord, record.GetLogSequenceNumber())
+	}
+
+	record.Data = data
+	record.Checksum = recordChecksum(data, record.GetLogSequenceNumber())
+	record.Blob = nil
+	return nil
+}
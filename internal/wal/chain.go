@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	pb "walstore/proto"
+)
+
+// ErrChainBroken is wrapped by the ChainBreakError VerifyChain returns.
+var ErrChainBroken = errors.New("hash chain broken")
+
+// ErrChainUnverifiable is returned by VerifyChain when the record a link points
+// to was deleted by retention, so the link can neither be confirmed nor refuted.
+var ErrChainUnverifiable = errors.New("hash chain link unverifiable")
+
+// ChainBreakError reports the first record whose link to the previous record
+// does not hold: the previous record, or this record's link, was edited,
+// removed or inserted.
+type ChainBreakError struct {
+	LSN    uint64
+	Reason string
+}
+
+func (err *ChainBreakError) Error() string {
+	return fmt.Sprintf("%v at lsn %d: %s", ErrChainBroken, err.LSN, err.Reason)
+}
+
+func (err *ChainBreakError) Unwrap() error {
+	return ErrChainBroken
+}
+
+// genesisHash is the previous hash of the first record of a WAL.
+var genesisHash = make([]byte, sha256.Size)
+
+// newChainHasher returns the hash records are chained with, HMAC-SHA256 when
+// a key is given so the chain can not be rebuilt by someone without it.
+func newChainHasher(key []byte) hash.Hash {
+	if key != nil {
+		return hmac.New(sha256.New, key)
+	}
+	return sha256.New()
+}
+
+// chainHash appends the hash of a record, as stored, to dst. It covers
+// everything but the CRC, including the link to the previous record.
+func chainHash(hasher hash.Hash, record *pb.WalRecord, dst []byte) []byte {
+	startChainHash(hasher, record)
+	hasher.Write(record.GetData())
+	return hasher.Sum(dst)
+}
+
+// startChainHash resets hasher and hashes everything chainHash covers but the
+// data, which may then be written in pieces.
+func startChainHash(hasher hash.Hash, record *pb.WalRecord) {
+	var header [8 + 8 + 4 + 4]byte
+	binary.LittleEndian.PutUint64(header[0:], record.GetLogSequenceNumber())
+	binary.LittleEndian.PutUint64(header[8:], uint64(record.GetTimestamp()))
+	binary.LittleEndian.PutUint32(header[16:], record.GetCodec())
+	binary.LittleEndian.PutUint32(header[20:], record.GetKeyId())
+
+	hasher.Reset()
+	hasher.Write(header[:])
+	hasher.Write(record.GetPrevHash())
+}
+
+// loadChainHead recovers the hash of the last record, which the next record
+// links to. Records written before the chain was turned on are linked to as
+// well, so the chain can start anywhere in the WAL.
+func (wal *WriteAheadLog) loadChainHead() error {
+	if wal.lastLogSequenceNumber == 0 {
+		wal.lastHash = append(wal.lastHash[:0], genesisHash...)
+		return nil
+	}
+
+	// The last LSN may belong to a record that never got its last part
+	iterator, err := wal.iterateReverse(wal.lastLogSequenceNumber, true)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	record, err := iterator.Next()
+	if err != nil {
+		return fmt.Errorf("failed to read the last record for the hash chain: %w", err)
+	}
+	wal.lastHash = chainHash(wal.chainHasher, record, wal.lastHash[:0])
+	return nil
+}
+
+// VerifyChain checks the hash chain of the records from fromLSN to toLSN and
+// returns a ChainBreakError for the first broken link. The link of the first
+// record is checked against the previous record while retention kept it;
+// otherwise the rest of the range is still verified and an error wrapping
+// ErrChainUnverifiable names the record whose link could not be. A toLSN past
+// the last record verifies up to the last record.
+func (wal *WriteAheadLog) VerifyChain(fromLSN uint64, toLSN uint64) error {
+	fromLSN = max(fromLSN, 1)
+	iterator, err := wal.iterate(fromLSN-1, true)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	hasher := newChainHasher(wal.chainKey)
+	var prevHash []byte
+	var unverifiedLSN uint64 // Record linking to one retention deleted, 0 if none
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		lsn := record.GetLogSequenceNumber()
+		if lsn > toLSN {
+			break
+		}
+		if lsn < fromLSN {
+			prevHash = chainHash(hasher, record, nil)
+			continue
+		}
+
+		if len(record.GetPrevHash()) == 0 {
+			return &ChainBreakError{LSN: lsn, Reason: "record is not chained"}
+		}
+		if prevHash == nil && lsn == 1 {
+			prevHash = genesisHash
+		}
+		if prevHash == nil {
+			unverifiedLSN = lsn
+		} else if !hmac.Equal(record.GetPrevHash(), prevHash) {
+			return &ChainBreakError{LSN: lsn, Reason: fmt.Sprintf("hash of lsn %d does not match", lsn-1)}
+		}
+		prevHash = chainHash(hasher, record, nil)
+	}
+
+	if unverifiedLSN != 0 {
+		return fmt.Errorf("%w: lsn %d links to lsn %d, which was deleted", ErrChainUnverifiable, unverifiedLSN, unverifiedLSN-1)
+	}
+	return nil
+}
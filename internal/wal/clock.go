@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is the WAL's source of time, used for sync timers, segment age and
+// record timestamps.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of time.Timer the WAL needs.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// nextTimestamp returns the timestamp of the next record in nanoseconds. With
+// monotonic timestamps it is a hybrid logical clock folded into a single
+// number: the physical time while it moves forward, otherwise the last
+// timestamp plus a logical tick of one nanosecond, so timestamps never repeat
+// and catch up with the clock once it passes them again. Must be called with
+// wal.lock held.
+func (wal *WriteAheadLog) nextTimestamp() int64 {
+	now := wal.clock.Now().UnixNano()
+	if wal.monotonicTimestamps && now <= wal.lastTimestamp {
+		return wal.lastTimestamp + 1
+	}
+	return now
+}
+
+// SystemClock is the Clock backed by the time package.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{timer: time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (timer *systemTimer) C() <-chan time.Time        { return timer.timer.C }
+func (timer *systemTimer) Reset(d time.Duration) bool { return timer.timer.Reset(d) }
+func (timer *systemTimer) Stop() bool                 { return timer.timer.Stop() }
+
+// FakeClock is a Clock that only moves when told to, so tests can control
+// when periodic syncs fire and which timestamps records get.
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // Active timers, fired and stopped ones are dropped
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.now
+}
+
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	timer := &fakeTimer{
+		clock:    clock,
+		channel:  make(chan time.Time, 1),
+		deadline: clock.now.Add(d),
+		active:   true,
+	}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward and fires every timer that became due.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+	active := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if timer.deadline.After(clock.now) {
+			active = append(active, timer)
+			continue
+		}
+		timer.active = false
+		select {
+		case timer.channel <- clock.now:
+		default:
+		}
+	}
+	clear(clock.timers[len(active):])
+	clock.timers = active
+}
+
+// Set moves the clock to t, which may be in the past to simulate a clock step.
+// Timers only fire when the clock moves forward.
+func (clock *FakeClock) Set(t time.Time) {
+	if d := t.Sub(clock.Now()); d > 0 {
+		clock.Advance(d)
+		return
+	}
+
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = t
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	channel  chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.channel
+}
+
+func (timer *fakeTimer) Reset(d time.Duration) bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+
+	wasActive := timer.active
+	timer.deadline = timer.clock.now.Add(d)
+	timer.active = true
+	if !wasActive {
+		timer.clock.timers = append(timer.clock.timers, timer)
+	}
+	return wasActive
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+
+	wasActive := timer.active
+	timer.active = false
+	timer.clock.timers = slices.DeleteFunc(timer.clock.timers, func(other *fakeTimer) bool { return other == timer })
+	return wasActive
+}
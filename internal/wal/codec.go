@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	pb "walstore/proto"
+)
+
+const (
+	CodecFlate uint32 = 1 // ID of the codecs returned by NewFlateCodec
+	CodecGzip  uint32 = 2 // ID of the codecs returned by NewGzipCodec
+
+	defaultCompressionThreshold = 256 // Records smaller than this are stored raw
+)
+
+// Codec compresses the data of records. Its ID is stored with every record it
+// compressed, so readers can pick the codec to decompress it with.
+type Codec interface {
+	ID() uint32                               // Unique and not 0, which marks raw records
+	Compress(dst, src []byte) ([]byte, error) // Appends the compressed src to dst
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[uint32]Codec{
+		CodecFlate: newFlateCodec(CodecFlate, flate.DefaultCompression),
+		CodecGzip:  newFlateCodec(CodecGzip, gzip.DefaultCompression),
+	}
+)
+
+// RegisterCodec makes a codec available for reading records, and for writing
+// them through Config.Codec. Codecs sharing an ID must read each other's
+// output, so a codec can only be replaced by one with another setting, such as
+// the compression level.
+func RegisterCodec(codec Codec) error {
+	if codec.ID() == 0 {
+		return fmt.Errorf("codec ID 0 is reserved for raw records")
+	}
+
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[codec.ID()] = codec
+	return nil
+}
+
+func lookupCodec(id uint32) Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecs[id]
+}
+
+// decodeRecord replaces the encrypted or compressed data of a record by the
+// original data. ciphers is nil when no KeyProvider is configured.
+func decodeRecord(record *pb.WalRecord, ciphers *cipherCache) error {
+	if record.GetKeyId() != 0 {
+		if ciphers == nil {
+			return fmt.Errorf("lsn %d is encrypted but no key provider is configured", record.GetLogSequenceNumber())
+		}
+		data, err := ciphers.decrypt(record)
+		if err != nil {
+			return err
+		}
+		record.Data = data
+		record.KeyId = 0
+	}
+
+	if record.GetCodec() == 0 {
+		return nil
+	}
+	codec := lookupCodec(record.GetCodec())
+	if codec == nil {
+		return fmt.Errorf("unknown codec %d for lsn %d", record.GetCodec(), record.GetLogSequenceNumber())
+	}
+
+	data, err := codec.Decompress(record.GetData())
+	if err != nil {
+		return fmt.Errorf("failed to decompress lsn %d: %w", record.GetLogSequenceNumber(), err)
+	}
+	record.Data = data
+	record.Codec = 0
+	return nil
+}
+
+// compress returns the data to store for a record and the ID of the codec
+// that compressed it. Small records, and records that do not get smaller, are
+// stored raw. Must be called with wal.lock held.
+func (wal *WriteAheadLog) compress(data []byte) ([]byte, uint32, error) {
+	if wal.codec == nil || len(data) < wal.compressionThreshold {
+		return data, 0, nil
+	}
+
+	compressed, err := wal.codec.Compress(wal.compressBuffer[:0], data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to compress record: %w", err)
+	}
+	if cap(compressed) <= maxScratchBufferSize {
+		wal.compressBuffer = compressed[:0]
+	}
+	if len(compressed) >= len(data) {
+		return data, 0, nil
+	}
+	return compressed, wal.codec.ID(), nil
+}
+
+// flateCodec compresses with DEFLATE, reusing its writers and readers since
+// they are expensive to allocate.
+type flateCodec struct {
+	id      uint32
+	writers sync.Pool
+	readers sync.Pool
+	gzip    bool
+}
+
+// NewFlateCodec returns a codec storing raw DEFLATE streams at the given
+// compression level of compress/flate.
+func NewFlateCodec(level int) (Codec, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", level)
+	}
+	return newFlateCodec(CodecFlate, level), nil
+}
+
+// NewGzipCodec returns a codec storing gzip streams at the given compression
+// level of compress/gzip, which are larger than raw DEFLATE streams but
+// readable by common tools.
+func NewGzipCodec(level int) (Codec, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", level)
+	}
+	return newFlateCodec(CodecGzip, level), nil
+}
+
+func newFlateCodec(id uint32, level int) *flateCodec {
+	codec := &flateCodec{id: id, gzip: id == CodecGzip}
+	codec.writers.New = func() any {
+		// The level was validated already
+		if codec.gzip {
+			writer, _ := gzip.NewWriterLevel(io.Discard, level)
+			return writer
+		}
+		writer, _ := flate.NewWriter(io.Discard, level)
+		return writer
+	}
+	return codec
+}
+
+func (codec *flateCodec) ID() uint32 {
+	return codec.id
+}
+
+// compressWriter is what flate.Writer and gzip.Writer have in common.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func (codec *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	writer := codec.writers.Get().(compressWriter)
+	defer codec.writers.Put(writer)
+
+	buffer := bytes.NewBuffer(dst)
+	writer.Reset(buffer)
+	if _, err := writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec *flateCodec) Decompress(src []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	if codec.gzip {
+		gzipReader, _ := codec.readers.Get().(*gzip.Reader)
+		if gzipReader == nil {
+			gzipReader = new(gzip.Reader)
+		}
+		if err := gzipReader.Reset(bytes.NewReader(src)); err != nil {
+			return nil, err
+		}
+		defer codec.readers.Put(gzipReader)
+		reader = gzipReader
+	} else {
+		flateReader, _ := codec.readers.Get().(io.ReadCloser)
+		if flateReader == nil {
+			flateReader = flate.NewReader(bytes.NewReader(src))
+		} else if err := flateReader.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+			return nil, err
+		}
+		defer codec.readers.Put(flateReader)
+		reader = flateReader
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return data, reader.Close()
+}
@@ -2,23 +2,65 @@ package wal
 
 import (
 	"fmt"
+	"time"
 )
 
 type Config struct {
-	Directory       string
-	MaxFileSize     int64
-	MaxSegments     int
-	EnableForceSync bool
-	SyncInterval    uint32 // in milliseconds
+	Directory            string
+	MaxFileSize          int64
+	MaxSegments          int           // Segment files to keep, the oldest sealed ones are deleted beyond it, 0 keeps them all
+	MaxSegmentAge        time.Duration // Delete sealed segments whose newest record is older than this by Clock, 0 keeps them regardless of age
+	EnableForceSync      bool
+	SyncInterval         uint32        // in milliseconds
+	Hooks                Hooks         // Optional lifecycle callbacks, nil disables them
+	FS                   FS            // File system holding the segments, the OS when nil
+	Clock                Clock         // Source of time for sync timers and timestamps, the system clock when nil
+	PreallocateSegments  bool          // Allocate MaxFileSize bytes per segment up front so fsync does not update the file size
+	RecycleSegments      bool          // Rename segments dropped by retention into the next segment slot instead of deleting them
+	SyncMode             SyncMode      // How writes are made durable, see SyncMode
+	MaxInFlightBytes     int64         // Unsynced bytes allowed before a write has to wait for a sync, 0 for no limit
+	RejectWhenFull       bool          // Fail writes over MaxInFlightBytes with ErrBackpressure instead of waiting
+	IndexInterval        int           // Records between two entries of a segment's sparse LSN index
+	SegmentNaming        SegmentNaming // How segment files are named, existing segments are migrated to SegmentNamingBaseLSN
+	MonotonicTimestamps  bool          // Guarantee strictly increasing record timestamps, even when the clock goes backwards
+	Codec                Codec         // Compresses record data, nil to store it raw as WriteRecordFrom needs; records stay readable when it changes
+	CompressionThreshold int           // Records with less data are stored raw
+	KeyProvider          KeyProvider   // Encrypts records with AES-GCM, nil to store them in plaintext as WriteRecordFrom needs
+	HashChain            bool          // Link every record to the hash of the previous one, see VerifyChain
+	ChainKey             []byte        // HMAC key for the hash chain, nil for plain SHA-256
+	ScrubInterval        time.Duration // Pause between two background passes re-verifying sealed segments, 0 disables scrubbing
+	ScrubRate            int64         // Bytes per second the scrubber reads, 0 for no limit
+	Framing              Framing       // How new segments frame their records, see Framing
+	BlobThreshold        int           // Records with more data, as stored, go to blob files and their segment only points there; 0 keeps all data in the segments
 }
 
 func CreateDefaultConfig(logDirectory string) *Config {
 	return &Config{
-		Directory:       logDirectory,
-		MaxFileSize:     1024 * 1024 * 16, // 16 MB
-		MaxSegments:     100,
-		EnableForceSync: true,
-		SyncInterval:    200, // 200 milliseconds
+		Directory:            logDirectory,
+		MaxFileSize:          1024 * 1024 * 16, // 16 MB
+		MaxSegments:          100,
+		MaxSegmentAge:        0,
+		EnableForceSync:      true,
+		SyncInterval:         200, // 200 milliseconds
+		FS:                   OSFS{},
+		Clock:                SystemClock{},
+		PreallocateSegments:  false,
+		RecycleSegments:      false,
+		SyncMode:             SyncModeFsync,
+		MaxInFlightBytes:     0,
+		RejectWhenFull:       false,
+		IndexInterval:        defaultIndexInterval,
+		SegmentNaming:        SegmentNamingCounter,
+		MonotonicTimestamps:  false,
+		Codec:                nil,
+		CompressionThreshold: defaultCompressionThreshold,
+		KeyProvider:          nil,
+		HashChain:            false,
+		ChainKey:             nil,
+		ScrubInterval:        0,
+		ScrubRate:            0,
+		Framing:              FramingLengthPrefix,
+		BlobThreshold:        0,
 	}
 }
 
@@ -26,5 +68,49 @@ func validateConfig(config *Config) error {
 	if config.Directory == "" {
 		return fmt.Errorf("directory cannot be empty")
 	}
+	if config.MaxFileSize < minSegmentSize {
+		return fmt.Errorf("max file size must be at least %d bytes", minSegmentSize)
+	}
+	if config.SyncMode < SyncModeFsync || config.SyncMode > SyncModeDirect {
+		return fmt.Errorf("unknown sync mode %d", config.SyncMode)
+	}
+	if config.IndexInterval < 0 {
+		return fmt.Errorf("index interval cannot be negative")
+	}
+	if config.MaxInFlightBytes < 0 {
+		return fmt.Errorf("max in-flight bytes cannot be negative")
+	}
+	if config.SegmentNaming != SegmentNamingCounter && config.SegmentNaming != SegmentNamingBaseLSN {
+		return fmt.Errorf("unknown segment naming %d", config.SegmentNaming)
+	}
+	if config.Framing != FramingLengthPrefix && config.Framing != FramingBlocks {
+		return fmt.Errorf("unknown framing %d", config.Framing)
+	}
+	if config.MaxSegments < 0 {
+		return fmt.Errorf("max segments cannot be negative")
+	}
+	if config.MaxSegmentAge < 0 {
+		return fmt.Errorf("max segment age cannot be negative")
+	}
+	if config.ScrubInterval < 0 || config.ScrubRate < 0 {
+		return fmt.Errorf("scrub interval and rate cannot be negative")
+	}
+	if config.CompressionThreshold < 0 {
+		return fmt.Errorf("compression threshold cannot be negative")
+	}
+	if config.BlobThreshold < 0 {
+		return fmt.Errorf("blob threshold cannot be negative")
+	}
+	if config.Codec != nil && lookupCodec(config.Codec.ID()) == nil {
+		return fmt.Errorf("codec %d is not registered", config.Codec.ID())
+	}
+	if config.KeyProvider != nil {
+		if _, _, err := newCipherCache(config.KeyProvider).currentAEAD(); err != nil {
+			return fmt.Errorf("invalid key provider: %w", err)
+		}
+	}
+	if !config.SyncMode.Supported() {
+		return fmt.Errorf("sync mode %s is not supported on this platform", config.SyncMode)
+	}
 	return nil
 }
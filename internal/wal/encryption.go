@@ -0,0 +1,189 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	pb "walstore/proto"
+)
+
+// ErrUnknownKey is returned for records encrypted with a key the KeyProvider
+// does not have.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// KeyProvider supplies the AES keys records are encrypted with. Key IDs are
+// stored with every record, so a key must never change once it got an ID, and
+// keys rotated away from must stay available for as long as their records
+// are in the WAL.
+type KeyProvider interface {
+	CurrentKey() (uint32, []byte, error) // ID and key new records are encrypted with, the ID must not be 0
+	Key(id uint32) ([]byte, error)       // Key with the given ID, ErrUnknownKey when there is none
+}
+
+// KeyRing is a KeyProvider holding its keys in memory.
+type KeyRing struct {
+	lock    sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyRing returns a key ring encrypting with the given key, which must be
+// 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewKeyRing(id uint32, key []byte) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[uint32][]byte)}
+	if err := ring.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Rotate makes the key with the given ID the one new records are encrypted
+// with. The previous keys stay available for reading.
+func (ring *KeyRing) Rotate(id uint32, key []byte) error {
+	if id == 0 {
+		return fmt.Errorf("key ID 0 is reserved for plaintext records")
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid key %d: %w", id, err)
+	}
+
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	if existing, ok := ring.keys[id]; ok && !bytes.Equal(existing, key) {
+		return fmt.Errorf("key %d already exists with different material", id)
+	}
+	ring.keys[id] = bytes.Clone(key)
+	ring.current = id
+	return nil
+}
+
+func (ring *KeyRing) CurrentKey() (uint32, []byte, error) {
+	ring.lock.RLock()
+	defer ring.lock.RUnlock()
+
+	return ring.current, ring.keys[ring.current], nil
+}
+
+func (ring *KeyRing) Key(id uint32) ([]byte, error) {
+	ring.lock.RLock()
+	defer ring.lock.RUnlock()
+
+	key, ok := ring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// cipherCache encrypts and decrypts records with AES-GCM, keeping a cipher
+// per key ID since setting one up is expensive.
+type cipherCache struct {
+	keys  KeyProvider
+	aeads sync.Map // Key ID to cipher.AEAD
+}
+
+func newCipherCache(keys KeyProvider) *cipherCache {
+	if keys == nil {
+		return nil
+	}
+	return &cipherCache{keys: keys}
+}
+
+func (cache *cipherCache) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	if aead, ok := cache.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = cache.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %d: %w", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	cache.aeads.Store(id, aead)
+	return aead, nil
+}
+
+// currentAEAD returns the cipher and ID of the key new records are encrypted
+// with.
+func (cache *cipherCache) currentAEAD() (cipher.AEAD, uint32, error) {
+	id, key, err := cache.keys.CurrentKey()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get the current encryption key: %w", err)
+	}
+	if id == 0 {
+		return nil, 0, fmt.Errorf("key ID 0 is reserved for plaintext records")
+	}
+	aead, err := cache.aead(id, key)
+	return aead, id, err
+}
+
+// associatedData binds a record's ciphertext to its LSN, so records can not
+// be swapped or replayed at another position.
+func associatedData(logSeqNumber uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, logSeqNumber)
+}
+
+// encrypt appends the random nonce and the sealed data to dst and returns it
+// along with the ID of the key used.
+func (cache *cipherCache) encrypt(dst []byte, data []byte, logSeqNumber uint64) ([]byte, uint32, error) {
+	aead, id, err := cache.currentAEAD()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dst = append(dst, make([]byte, aead.NonceSize())...)
+	nonce := dst[len(dst)-aead.NonceSize():]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(dst, nonce, data, associatedData(logSeqNumber)), id, nil
+}
+
+func (cache *cipherCache) decrypt(record *pb.WalRecord) ([]byte, error) {
+	aead, err := cache.aead(record.GetKeyId(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := record.GetData()
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: encrypted data of lsn %d is truncated", ErrCorruptRecord, record.GetLogSequenceNumber())
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], associatedData(record.GetLogSequenceNumber()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt lsn %d: %v", ErrCorruptRecord, record.GetLogSequenceNumber(), err)
+	}
+	return data, nil
+}
+
+// encrypt returns the data to store for a record and the ID of the key that
+// encrypted it, 0 when encryption is off. Must be called with wal.lock held.
+func (wal *WriteAheadLog) encrypt(data []byte, logSeqNumber uint64) ([]byte, uint32, error) {
+	if wal.ciphers == nil {
+		return data, 0, nil
+	}
+
+	sealed, keyID, err := wal.ciphers.encrypt(wal.encryptBuffer[:0], data, logSeqNumber)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encrypt record: %w", err)
+	}
+	if cap(sealed) <= maxScratchBufferSize {
+		wal.encryptBuffer = sealed[:0]
+	}
+	return sealed, keyID, nil
+}
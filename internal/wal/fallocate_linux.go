@@ -0,0 +1,20 @@
+//go:build linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate reserves blocks for the first size bytes of the file, so appends
+// within that range do not change the file size.
+func fallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		// The file system cannot preallocate, fall back to a sparse file
+		return extendFile(file, size)
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package wal
+
+import (
+	"os"
+)
+
+// fallocate extends the file to size bytes. Without fallocate(2) the blocks
+// are not reserved, but the file size no longer changes on append.
+func fallocate(file *os.File, size int64) error {
+	return extendFile(file, size)
+}
@@ -0,0 +1,232 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrInjectedFault is the default error returned by a triggered Fault.
+var ErrInjectedFault = errors.New("injected fault")
+
+type FaultOp int
+
+const (
+	FaultOpOpen FaultOp = iota
+	FaultOpRead
+	FaultOpWrite
+	FaultOpSync
+	FaultOpClose
+	FaultOpRemove
+	FaultOpRename
+	FaultOpSyncDir
+)
+
+// Fault describes a call FaultFS should fail.
+type Fault struct {
+	Op         FaultOp // Operation to fail
+	Path       string  // Substring the file path must contain, empty matches every path
+	After      int     // Number of matching calls to let through before failing
+	Err        error   // Error to return, ErrInjectedFault when nil
+	ShortWrite int     // For FaultOpWrite, bytes written before the error is returned
+	Sticky     bool    // Keep failing every matching call once triggered
+}
+
+// FaultFS wraps another FS and fails calls according to the injected faults.
+// Combined with MemFS it can also drop un-fsynced data to simulate a crash.
+type FaultFS struct {
+	inner  FS
+	lock   sync.Mutex
+	faults []*injectedFault
+}
+
+type injectedFault struct {
+	Fault
+	seen      int
+	triggered bool
+}
+
+func NewFaultFS(inner FS) *FaultFS {
+	return &FaultFS{inner: inner}
+}
+
+// Inject arms a new fault.
+func (faultFS *FaultFS) Inject(fault Fault) {
+	faultFS.lock.Lock()
+	defer faultFS.lock.Unlock()
+
+	faultFS.faults = append(faultFS.faults, &injectedFault{Fault: fault})
+}
+
+// Reset disarms all faults.
+func (faultFS *FaultFS) Reset() {
+	faultFS.lock.Lock()
+	defer faultFS.lock.Unlock()
+
+	faultFS.faults = nil
+}
+
+// Triggered reports how many faults fired so far.
+func (faultFS *FaultFS) Triggered() int {
+	faultFS.lock.Lock()
+	defer faultFS.lock.Unlock()
+
+	count := 0
+	for _, fault := range faultFS.faults {
+		if fault.triggered {
+			count++
+		}
+	}
+	return count
+}
+
+// Crash drops everything that was not fsynced. The wrapped FS must be a MemFS.
+func (faultFS *FaultFS) Crash() error {
+	memFS, ok := faultFS.inner.(*MemFS)
+	if !ok {
+		return fmt.Errorf("crash simulation needs a MemFS, got %T", faultFS.inner)
+	}
+	memFS.Crash()
+	return nil
+}
+
+// Corrupt flips every bit of the bytes at offset in the named file.
+func (faultFS *FaultFS) Corrupt(name string, offset int64, length int) error {
+	file, err := faultFS.inner.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	original := make([]byte, length)
+	if _, err := io.ReadFull(file, original); err != nil {
+		return fmt.Errorf("failed to read bytes to corrupt: %w", err)
+	}
+	for i := range original {
+		original[i] ^= 0xFF
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = file.Write(original)
+	return err
+}
+
+// match returns the fault to apply to this call, if any.
+func (faultFS *FaultFS) match(op FaultOp, path string) *injectedFault {
+	faultFS.lock.Lock()
+	defer faultFS.lock.Unlock()
+
+	for _, fault := range faultFS.faults {
+		if fault.Op != op || !strings.Contains(path, fault.Path) {
+			continue
+		}
+		if fault.triggered {
+			if fault.Sticky {
+				return fault
+			}
+			continue
+		}
+		if fault.seen < fault.After {
+			fault.seen++
+			continue
+		}
+		fault.triggered = true
+		return fault
+	}
+	return nil
+}
+
+func (fault *injectedFault) err() error {
+	if fault.Err != nil {
+		return fault.Err
+	}
+	return ErrInjectedFault
+}
+
+func (faultFS *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fault := faultFS.match(FaultOpOpen, name); fault != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fault.err()}
+	}
+	file, err := faultFS.inner.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, faultFS: faultFS}, nil
+}
+
+func (faultFS *FaultFS) Remove(name string) error {
+	if fault := faultFS.match(FaultOpRemove, name); fault != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: fault.err()}
+	}
+	return faultFS.inner.Remove(name)
+}
+
+func (faultFS *FaultFS) Rename(oldPath, newPath string) error {
+	if fault := faultFS.match(FaultOpRename, oldPath); fault != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fault.err()}
+	}
+	return faultFS.inner.Rename(oldPath, newPath)
+}
+
+func (faultFS *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return faultFS.inner.MkdirAll(path, perm)
+}
+
+func (faultFS *FaultFS) Glob(pattern string) ([]string, error) {
+	return faultFS.inner.Glob(pattern)
+}
+
+func (faultFS *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return faultFS.inner.Stat(name)
+}
+
+func (faultFS *FaultFS) SyncDir(dir string) error {
+	if fault := faultFS.match(FaultOpSyncDir, dir); fault != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: fault.err()}
+	}
+	return faultFS.inner.SyncDir(dir)
+}
+
+type faultFile struct {
+	File
+	faultFS *FaultFS
+}
+
+func (file *faultFile) Read(buffer []byte) (int, error) {
+	if fault := file.faultFS.match(FaultOpRead, file.Name()); fault != nil {
+		return 0, &os.PathError{Op: "read", Path: file.Name(), Err: fault.err()}
+	}
+	return file.File.Read(buffer)
+}
+
+func (file *faultFile) Write(buffer []byte) (int, error) {
+	if fault := file.faultFS.match(FaultOpWrite, file.Name()); fault != nil {
+		written := 0
+		if fault.ShortWrite > 0 {
+			written, _ = file.File.Write(buffer[:min(fault.ShortWrite, len(buffer))])
+		}
+		return written, &os.PathError{Op: "write", Path: file.Name(), Err: fault.err()}
+	}
+	return file.File.Write(buffer)
+}
+
+func (file *faultFile) Sync() error {
+	if fault := file.faultFS.match(FaultOpSync, file.Name()); fault != nil {
+		return &os.PathError{Op: "sync", Path: file.Name(), Err: fault.err()}
+	}
+	return file.File.Sync()
+}
+
+func (file *faultFile) Close() error {
+	if fault := file.faultFS.match(FaultOpClose, file.Name()); fault != nil {
+		return &os.PathError{Op: "close", Path: file.Name(), Err: fault.err()}
+	}
+	return file.File.Close()
+}
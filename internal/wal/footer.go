@@ -0,0 +1,263 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// ErrNoFooter is returned for segments without a footer: the current segment,
+// segments sealed before footers existed, or a footer torn by a crash before
+// its magic was written.
+var ErrNoFooter = errors.New("segment has no footer")
+
+// ErrCorruptFooter is returned for a footer that follows the terminator with
+// its magic intact but fails its checksum. It wraps ErrCorruptRecord.
+var ErrCorruptFooter = fmt.Errorf("%w: segment footer fails its checksum", ErrCorruptRecord)
+
+const (
+	footerMagic   = 0x52544657 // "WFTR" in little endian
+	footerVersion = 1
+	footerSize    = 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 8 + 4 + 4
+	footerReserve = 4 + footerSize // Room kept in every segment for the terminator and the footer
+)
+
+// SegmentFooter summarises a sealed segment. It is written right after the
+// terminator that follows the last record, so readers never mistake it for a
+// record.
+type SegmentFooter struct {
+	RecordCount  uint64
+	FirstLSN     uint64 // 0 if the segment holds no records
+	LastLSN      uint64
+	MinTimestamp int64
+	MaxTimestamp int64
+	PayloadBytes uint64 // Bytes of record data as stored, after compression and encryption
+	DataSize     int64  // Offset right after the last record
+	Checksum     uint32 // CRC-32 of the first DataSize bytes of the segment
+}
+
+func (footer *SegmentFooter) encode() []byte {
+	buffer := make([]byte, 0, footerSize)
+	buffer = binary.LittleEndian.AppendUint32(buffer, footerMagic)
+	buffer = binary.LittleEndian.AppendUint32(buffer, footerVersion)
+	buffer = binary.LittleEndian.AppendUint64(buffer, footer.RecordCount)
+	buffer = binary.LittleEndian.AppendUint64(buffer, footer.FirstLSN)
+	buffer = binary.LittleEndian.AppendUint64(buffer, footer.LastLSN)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(footer.MinTimestamp))
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(footer.MaxTimestamp))
+	buffer = binary.LittleEndian.AppendUint64(buffer, footer.PayloadBytes)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(footer.DataSize))
+	buffer = binary.LittleEndian.AppendUint32(buffer, footer.Checksum)
+	return binary.LittleEndian.AppendUint32(buffer, crc32.ChecksumIEEE(buffer))
+}
+
+func decodeFooter(buffer []byte) (*SegmentFooter, error) {
+	if len(buffer) != footerSize || binary.LittleEndian.Uint32(buffer[0:]) != footerMagic {
+		return nil, ErrNoFooter
+	}
+	if binary.LittleEndian.Uint32(buffer[4:]) != footerVersion ||
+		crc32.ChecksumIEEE(buffer[:footerSize-4]) != binary.LittleEndian.Uint32(buffer[footerSize-4:]) {
+		return nil, ErrCorruptFooter
+	}
+
+	return &SegmentFooter{
+		RecordCount:  binary.LittleEndian.Uint64(buffer[8:]),
+		FirstLSN:     binary.LittleEndian.Uint64(buffer[16:]),
+		LastLSN:      binary.LittleEndian.Uint64(buffer[24:]),
+		MinTimestamp: int64(binary.LittleEndian.Uint64(buffer[32:])),
+		MaxTimestamp: int64(binary.LittleEndian.Uint64(buffer[40:])),
+		PayloadBytes: binary.LittleEndian.Uint64(buffer[48:]),
+		DataSize:     int64(binary.LittleEndian.Uint64(buffer[56:])),
+		Checksum:     binary.LittleEndian.Uint32(buffer[64:]),
+	}, nil
+}
+
+// newFooter summarises the records of a segment's index.
+func newFooter(index *segmentIndex) *SegmentFooter {
+	footer := &SegmentFooter{
+		PayloadBytes: index.payloadBytes,
+		DataSize:     index.size,
+		Checksum:     index.checksum,
+	}
+	if !index.empty() {
+		footer.RecordCount = index.lastLSN - index.firstLSN + 1
+		footer.FirstLSN = index.firstLSN
+		footer.LastLSN = index.lastLSN
+		footer.MinTimestamp = index.minTimestamp
+		footer.MaxTimestamp = index.maxTimestamp
+	}
+	return footer
+}
+
+// readFooterAt reads the footer of a segment whose records end at dataSize.
+func readFooterAt(file File, dataSize int64) (*SegmentFooter, error) {
+	if _, err := file.Seek(dataSize, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek: %w", err)
+	}
+	buffer := make([]byte, footerReserve)
+	if _, err := io.ReadFull(file, buffer); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNoFooter
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buffer) != 0 {
+		return nil, ErrNoFooter
+	}
+
+	footer, err := decodeFooter(buffer[4:])
+	if err != nil {
+		return nil, err
+	}
+	if footer.DataSize != dataSize {
+		return nil, ErrNoFooter
+	}
+	return footer, nil
+}
+
+// readSegmentFooter reads the footer of a segment whose records end at
+// dataSize, as known from its index, without reading any record.
+func readSegmentFooter(fs FS, segmentPath string, dataSize int64) (*SegmentFooter, error) {
+	file, err := fs.OpenFile(segmentPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readFooterAt(file, dataSize)
+}
+
+// ReadSegmentFooter reads the footer of a sealed segment file. The footer
+// ends the file unless the segment was preallocated or recycled; then the
+// record sizes are followed to find the end of the records, without reading
+// the records themselves.
+func ReadSegmentFooter(fs FS, segmentPath string) (*SegmentFooter, error) {
+	file, err := fs.OpenFile(segmentPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// A recycled segment can still end with the footer of its former life,
+	// which its first record gives away
+	if footer, err := readFooterAt(file, fileInfo.Size()-footerReserve); err == nil {
+		firstLSN, err := readFirstLSN(fs, segmentPath)
+		if err != nil {
+			return nil, err
+		}
+		if firstLSN == footer.FirstLSN {
+			return footer, nil
+		}
+	}
+
+	dataSize, err := skipRecords(file, fileInfo.Size())
+	if err != nil {
+		return nil, err
+	}
+	return readFooterAt(file, dataSize)
+}
+
+// readFirstLSN returns the LSN of the first record of a segment, 0 if it has
+// none.
+func readFirstLSN(fs FS, segmentPath string) (uint64, error) {
+	reader, err := openSegmentReader(fs, segmentPath, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.close()
+
+	record, _, err := reader.next()
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return record.GetLogSequenceNumber(), nil
+}
+
+// skipRecords follows the record sizes from the start of a segment and
+// returns the offset of the terminator ending its records.
+func skipRecords(file File, fileSize int64) (int64, error) {
+	framing, err := detectFraming(file)
+	if err != nil {
+		return 0, err
+	}
+	if framing == FramingBlocks {
+		return skipFragments(file, fileSize)
+	}
+
+	var header [4]byte
+	var offset int64
+	for {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek: %w", err)
+		}
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, ErrNoFooter
+			}
+			return 0, err
+		}
+		recordSize := int32(binary.LittleEndian.Uint32(header[:]))
+		if recordSize == 0 {
+			return offset, nil
+		}
+		if recordSize < 0 || offset+4+int64(recordSize) > fileSize {
+			return 0, fmt.Errorf("%w: invalid record size %d at offset %d in %s", ErrCorruptRecord, recordSize, offset, file.Name())
+		}
+		offset += 4 + int64(recordSize)
+	}
+}
+
+// VerifySegment checks a sealed segment against the checksum in its footer
+// and returns the footer.
+func VerifySegment(fs FS, segmentPath string) (*SegmentFooter, error) {
+	footer, err := ReadSegmentFooter(fs, segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySegmentChecksum(fs, segmentPath, footer); err != nil {
+		return nil, err
+	}
+	return footer, nil
+}
+
+func verifySegmentChecksum(fs FS, segmentPath string, footer *SegmentFooter) error {
+	file, err := fs.OpenFile(segmentPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checksum := crc32.NewIEEE()
+	if _, err := io.CopyN(checksum, file, footer.DataSize); err != nil {
+		return fmt.Errorf("failed to read segment %s: %w", segmentPath, err)
+	}
+	if checksum.Sum32() != footer.Checksum {
+		return fmt.Errorf("%w: checksum mismatch for segment %s", ErrCorruptRecord, segmentPath)
+	}
+	return nil
+}
+
+// writeFooter ends the records of the current segment with a terminator and
+// its footer. Appending more records overwrites both.
+func (wal *WriteAheadLog) writeFooter() error {
+	index := wal.currentIndex()
+	index.size = wal.currSegmentSize
+	if _, err := wal.bufferWriter.Write(segmentTerminator); err != nil {
+		return fmt.Errorf("failed to write segment terminator: %w", err)
+	}
+	if _, err := wal.bufferWriter.Write(newFooter(index).encode()); err != nil {
+		return fmt.Errorf("failed to write segment footer: %w", err)
+	}
+	return nil
+}
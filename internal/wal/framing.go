@@ -0,0 +1,436 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	pb "walstore/proto"
+)
+
+// Framing selects how new segments lay out their records. Every segment keeps
+// the framing it was written with, so it can be changed at any time.
+type Framing int
+
+const (
+	FramingLengthPrefix Framing = iota // Records are preceded by their size, corruption makes the rest of a segment unreadable
+	FramingBlocks                      // Records are split into checksummed fragments in 32 KiB blocks, readers resync at the next block
+)
+
+const (
+	blockSize          = 32 * 1024
+	fragmentHeaderSize = 2 + 1 + 4 // Payload length, fragment type and CRC-32 of type and payload
+)
+
+// Fragment types. A zero header ends the records, like a segment terminator.
+const (
+	fragmentFull   = 1 // A whole record
+	fragmentFirst  = 2
+	fragmentMiddle = 3
+	fragmentLast   = 4
+)
+
+// blockMagic starts every segment framed in blocks. Taken as the size of a
+// length prefixed record it is larger than any segment.
+var blockMagic = []byte("WALBLOCK")
+
+// blockPadding fills the end of a block too short for another fragment.
+var blockPadding = make([]byte, fragmentHeaderSize)
+
+// detectFraming returns the framing of a segment file from its first bytes.
+// Empty segments, including recycled ones, read as FramingLengthPrefix.
+func detectFraming(file File) (Framing, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek: %w", err)
+	}
+	magic := make([]byte, len(blockMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return FramingLengthPrefix, nil
+		}
+		return 0, err
+	}
+	if bytes.Equal(magic, blockMagic) {
+		return FramingBlocks, nil
+	}
+	return FramingLengthPrefix, nil
+}
+
+func readFraming(fs FS, segmentPath string) (Framing, error) {
+	file, err := fs.OpenFile(segmentPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return detectFraming(file)
+}
+
+// trailerSize returns the bytes left in the block at offset when they are too
+// few for another fragment, 0 otherwise.
+func trailerSize(offset int64) int64 {
+	if remaining := blockSize - offset%blockSize; remaining <= fragmentHeaderSize {
+		return remaining
+	}
+	return 0
+}
+
+// fragmentChecksum is the CRC-32 of the fragment type followed by the payload.
+func fragmentChecksum(fragmentType byte, payload []byte) uint32 {
+	// Same as crc32.Update with the single type byte, without allocating a slice for it
+	checksum := crc32.IEEETable[0xff^fragmentType] ^ (^uint32(0) >> 8)
+	return crc32.Update(^checksum, crc32.IEEETable, payload)
+}
+
+// framedSize returns the bytes a record of size bytes takes at the end of the
+// current segment, including its length prefix or its fragment headers and
+// the padding behind them.
+func (wal *WriteAheadLog) framedSize(size int) int64 {
+	return framedSizeAt(wal.currSegmentSize, wal.blockFraming, size)
+}
+
+// framedSizeAt is framedSize for a segment of segmentSize bytes, framed in
+// blocks when blocks is set.
+func framedSizeAt(segmentSize int64, blocks bool, size int) int64 {
+	if !blocks {
+		return 4 + int64(size)
+	}
+
+	offset := max(segmentSize, int64(len(blockMagic)))
+	for remaining := int64(size); remaining > 0; {
+		fragment := min(remaining, blockSize-offset%blockSize-fragmentHeaderSize)
+		offset += fragmentHeaderSize + fragment
+		offset += trailerSize(offset)
+		remaining -= fragment
+	}
+	return offset - segmentSize
+}
+
+// writeFragments writes the data of a record as fragments, starting the
+// segment with the magic when it is empty and padding the block behind the
+// last fragment when no other one fits. It returns the offset of the first
+// fragment.
+func (wal *WriteAheadLog) writeFragments(data []byte) (int64, error) {
+	if wal.currSegmentSize == 0 {
+		if err := wal.writeBytes(blockMagic); err != nil {
+			return 0, err
+		}
+	}
+	recordOffset := wal.currSegmentSize
+
+	for first := true; ; first = false {
+		fragment := data[:min(int64(len(data)), blockSize-wal.currSegmentSize%blockSize-fragmentHeaderSize)]
+		data = data[len(fragment):]
+
+		fragmentType := byte(fragmentMiddle)
+		switch {
+		case first && len(data) == 0:
+			fragmentType = fragmentFull
+		case first:
+			fragmentType = fragmentFirst
+		case len(data) == 0:
+			fragmentType = fragmentLast
+		}
+		header := wal.fragmentHeader[:]
+		binary.LittleEndian.PutUint16(header[0:], uint16(len(fragment)))
+		header[2] = fragmentType
+		binary.LittleEndian.PutUint32(header[3:], fragmentChecksum(fragmentType, fragment))
+
+		if err := wal.writeBytes(header); err != nil {
+			return 0, err
+		}
+		if err := wal.writeBytes(fragment); err != nil {
+			return 0, err
+		}
+		if trailer := trailerSize(wal.currSegmentSize); trailer > 0 {
+			if err := wal.writeBytes(blockPadding[:trailer]); err != nil {
+				return 0, err
+			}
+		}
+		if len(data) == 0 {
+			return recordOffset, nil
+		}
+	}
+}
+
+// skipFragments is skipRecords for segments framed in blocks.
+func skipFragments(file File, fileSize int64) (int64, error) {
+	var header [fragmentHeaderSize]byte
+	offset := int64(len(blockMagic))
+	for {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek: %w", err)
+		}
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, ErrNoFooter
+			}
+			return 0, err
+		}
+		length := int64(binary.LittleEndian.Uint16(header[0:]))
+		if length == 0 && header[2] == 0 {
+			return offset, nil
+		}
+		if length > blockSize-offset%blockSize-fragmentHeaderSize || offset+fragmentHeaderSize+length > fileSize {
+			return 0, fmt.Errorf("%w: invalid fragment header at offset %d in %s", ErrCorruptRecord, offset, file.Name())
+		}
+		offset += fragmentHeaderSize + length
+		offset += trailerSize(offset)
+	}
+}
+
+// readFragments reassembles the data of the next record from its fragments.
+func (reader *segmentReader) readFragments() ([]byte, error) {
+	var data []byte
+	inRecord := false
+	for {
+		fragmentOffset := reader.position
+		if reader.limit >= 0 && fragmentOffset >= reader.limit {
+			if inRecord {
+				reader.brokenAt = fragmentOffset
+				return nil, fmt.Errorf("%w: record at offset %d in %s is cut off", ErrCorruptRecord, reader.offset, reader.path)
+			}
+			return nil, io.EOF
+		}
+
+		header := reader.header[:]
+		if err := reader.read(header); err != nil {
+			reader.brokenAt = fragmentOffset
+			if err == io.EOF && !inRecord {
+				return nil, io.EOF
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("%w: torn fragment at offset %d in %s", ErrCorruptRecord, fragmentOffset, reader.path)
+			}
+			return nil, err
+		}
+		length := int64(binary.LittleEndian.Uint16(header[0:]))
+		fragmentType := header[2]
+		if length == 0 && fragmentType == 0 && !inRecord {
+			// Segment terminator or preallocated space, no more records
+			reader.brokenAt = fragmentOffset
+			return nil, io.EOF
+		}
+		if fragmentType < fragmentFull || fragmentType > fragmentLast || length == 0 || length > blockSize-fragmentOffset%blockSize-fragmentHeaderSize {
+			reader.brokenAt = fragmentOffset
+			return nil, fmt.Errorf("%w: invalid fragment header at offset %d in %s", ErrCorruptRecord, fragmentOffset, reader.path)
+		}
+		checksum := binary.LittleEndian.Uint32(header[3:])
+
+		payload := make([]byte, length)
+		if err := reader.read(payload); err != nil {
+			reader.brokenAt = fragmentOffset
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("%w: torn fragment at offset %d in %s", ErrCorruptRecord, fragmentOffset, reader.path)
+			}
+			return nil, err
+		}
+		if checksum != fragmentChecksum(fragmentType, payload) {
+			reader.brokenAt = fragmentOffset
+			return nil, fmt.Errorf("%w: checksum mismatch for fragment at offset %d in %s", ErrCorruptRecord, fragmentOffset, reader.path)
+		}
+		if trailer := trailerSize(reader.position); trailer > 0 {
+			// The padding is only missing when the file ends, which the next read reports
+			if reader.read(reader.header[:trailer]) != nil {
+				reader.position += trailer
+			}
+		}
+
+		switch {
+		case fragmentType == fragmentFull || fragmentType == fragmentFirst:
+			if inRecord {
+				reader.brokenAt = fragmentOffset
+				return nil, fmt.Errorf("%w: fragment at offset %d in %s interrupts a record", ErrCorruptRecord, fragmentOffset, reader.path)
+			}
+			if fragmentType == fragmentFull {
+				reader.resyncing = false
+				return payload, nil
+			}
+			data, inRecord = payload, true
+		case !inRecord:
+			if reader.resyncing {
+				// The rest of a record that started before the block we resynced at
+				reader.offset = reader.position
+				continue
+			}
+			reader.brokenAt = fragmentOffset
+			return nil, fmt.Errorf("%w: fragment at offset %d in %s continues no record", ErrCorruptRecord, fragmentOffset, reader.path)
+		default:
+			data = append(data, payload...)
+			if fragmentType == fragmentLast {
+				reader.resyncing = false
+				return data, nil
+			}
+		}
+	}
+}
+
+// read fills buffer from the segment, accounting for the bytes in position
+// and checksum.
+func (reader *segmentReader) read(buffer []byte) error {
+	if _, err := io.ReadFull(reader.reader, buffer); err != nil {
+		return err
+	}
+	reader.position += int64(len(buffer))
+	reader.checksum = crc32.Update(reader.checksum, crc32.IEEETable, buffer)
+	return nil
+}
+
+// resync moves a reader that ran into a corrupt record past it and reports
+// whether there is anything left to read. A record that was framed correctly
+// is simply skipped. Otherwise reading resumes at the next block, where
+// fragments can be trusted again; segments framed by length prefix have no
+// place to resume at.
+func (reader *segmentReader) resync() (bool, error) {
+	next := reader.position
+	if reader.brokenAt >= 0 {
+		if !reader.blocks {
+			return false, nil
+		}
+		next = (reader.brokenAt/blockSize + 1) * blockSize
+	}
+	if next >= reader.fileSize || (reader.limit >= 0 && next >= reader.limit) {
+		return false, nil
+	}
+
+	if err := reader.reset(next, reader.limit); err != nil {
+		return false, err
+	}
+	reader.resyncing = true
+	return true, nil
+}
+
+// LostRecords is a range of records SalvageRecords could not read.
+type LostRecords struct {
+	Segment  string // Segment the records were in
+	FirstLSN uint64
+	LastLSN  uint64
+	Err      error // Corruption that made them unreadable
+}
+
+// SalvageRecords reads every record it can, oldest first. Unlike
+// ReadAllRecords it does not stop at corruption but skips the damaged records
+// and reports which LSNs were lost. Segments framed in blocks are read again
+// from the next block after the damage, segments framed by length prefix only
+// from the next intact record, so their whole rest is lost to a corrupt size.
+func (wal *WriteAheadLog) SalvageRecords() ([]*pb.WalRecord, []LostRecords, error) {
+	wal.lock.Lock()
+	if err := wal.flushForReaders(); err != nil {
+		wal.lock.Unlock()
+		return nil, nil, err
+	}
+	segments := make([]segmentIndex, 0, len(wal.segments))
+	for _, index := range wal.segments {
+		if index.empty() {
+			continue
+		}
+		segment := segmentIndex{path: index.path, firstLSN: index.firstLSN, lastLSN: index.lastLSN, size: index.size}
+		if index == wal.currentIndex() {
+			segment.size = wal.currSegmentSize
+		}
+		segments = append(segments, segment)
+	}
+	wal.lock.Unlock()
+
+	var walRecords []*pb.WalRecord
+	var lost []LostRecords
+	var parts recordParts
+	for i := range segments {
+		records, segmentLost, err := salvageSegment(wal.fs, &segments[i])
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted by retention while we were reading
+			continue
+		}
+		if err != nil {
+			return walRecords, lost, err
+		}
+		lost = append(lost, segmentLost...)
+
+		for _, record := range records {
+			if record = parts.add(record); record == nil {
+				continue
+			}
+			err := readBlob(wal.fs, wal.directory, record)
+			if err == nil {
+				err = decodeRecord(record, wal.ciphers)
+			}
+			if err != nil {
+				lsn := record.GetLogSequenceNumber()
+				lost = append(lost, LostRecords{Segment: segments[i].path, FirstLSN: lsn, LastLSN: lsn, Err: err})
+				continue
+			}
+			walRecords = append(walRecords, record)
+		}
+	}
+	return walRecords, lost, nil
+}
+
+// salvageSegment reads the records of a segment its index knows about,
+// skipping corrupt ones.
+func salvageSegment(fs FS, index *segmentIndex) ([]*pb.WalRecord, []LostRecords, error) {
+	reader, err := openSegmentReader(fs, index.path, 0, index.size)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.close()
+
+	var records []*pb.WalRecord
+	var lost []LostRecords
+	var corruption error
+	nextLSN := index.firstLSN // First LSN not read or reported lost yet
+	var continued bool        // The record read last has more parts
+	for nextLSN <= index.lastLSN || continued {
+		record, _, err := reader.next()
+		if err == io.EOF || errors.Is(err, ErrCorruptRecord) {
+			// Records are missing, so the end may be a zeroed stretch of blocks
+			if corruption == nil {
+				corruption = err
+			}
+			resynced, err := reader.resync()
+			if err != nil {
+				return records, lost, err
+			}
+			if !resynced {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return records, lost, err
+		}
+
+		lsn := record.GetLogSequenceNumber()
+		if lsn == nextLSN-1 && record.GetPart() > 0 {
+			// Another part of the record read last
+			records = append(records, record)
+			continued = record.GetContinued()
+			continue
+		}
+		if lsn < nextLSN || lsn > index.lastLSN {
+			// A stale record of a recycled segment
+			continue
+		}
+		if lsn > nextLSN {
+			lost = append(lost, lostRecords(index.path, nextLSN, lsn-1, corruption))
+		}
+		records = append(records, record)
+		nextLSN = lsn + 1
+		continued = record.GetContinued()
+		corruption = nil
+	}
+
+	if nextLSN <= index.lastLSN {
+		lost = append(lost, lostRecords(index.path, nextLSN, index.lastLSN, corruption))
+	}
+	return records, lost, nil
+}
+
+func lostRecords(segmentPath string, firstLSN uint64, lastLSN uint64, err error) LostRecords {
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("%w: lsn %d to %d are missing from %s", ErrCorruptRecord, firstLSN, lastLSN, segmentPath)
+	}
+	return LostRecords{Segment: segmentPath, FirstLSN: firstLSN, LastLSN: lastLSN, Err: err}
+}
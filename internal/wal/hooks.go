@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"sync"
+)
+
+// SegmentInfo describes a segment file at the moment a lifecycle event fired.
+type SegmentInfo struct {
+	Path     string // Path of the segment file
+	FirstLSN uint64 // First log sequence number in the segment, 0 if it holds no records
+	LastLSN  uint64 // Last log sequence number in the segment, 0 if it holds no records
+	Size     int64  // Size of the segment file in bytes
+}
+
+// Hooks receives WAL lifecycle events. Callbacks run on a dedicated goroutine,
+// in the order the events happened and never while the WAL lock is held, so a
+// slow hook delays later hooks but never writers.
+type Hooks interface {
+	// OnRotate is called after a segment is sealed and a new one has been created.
+	OnRotate(sealed SegmentInfo, next SegmentInfo)
+	// OnSync is called after buffered records were flushed (and fsynced when
+	// force sync is enabled). LastLSN is the last record covered by the sync.
+	OnSync(segment SegmentInfo)
+	// OnSegmentDeleted is called after the oldest segment was removed by retention.
+	OnSegmentDeleted(deleted SegmentInfo)
+}
+
+// CorruptionHooks is implemented by Hooks that also want to hear about
+// corruption found by the scrubber. It is checked for on the Hooks passed in
+// Config, so existing Hooks implementations keep working.
+type CorruptionHooks interface {
+	// OnCorruption is called when the scrubber found a sealed segment damaged.
+	OnCorruption(segment SegmentInfo, err error)
+}
+
+// NoopHooks implements Hooks and CorruptionHooks with empty callbacks. Embed it to override only
+// the events you are interested in.
+type NoopHooks struct{}
+
+func (NoopHooks) OnRotate(sealed SegmentInfo, next SegmentInfo) {}
+func (NoopHooks) OnSync(segment SegmentInfo)                    {}
+func (NoopHooks) OnSegmentDeleted(deleted SegmentInfo)          {}
+func (NoopHooks) OnCorruption(segment SegmentInfo, err error)   {}
+
+// hookQueue delivers events to Hooks from a single goroutine. Pushing never
+// blocks, so it is safe to call while holding the WAL lock.
+type hookQueue struct {
+	hooks  Hooks
+	lock   sync.Mutex
+	cond   *sync.Cond
+	events []func(Hooks)
+	closed bool
+	done   chan struct{}
+}
+
+func newHookQueue(hooks Hooks) *hookQueue {
+	queue := &hookQueue{
+		hooks: hooks,
+		done:  make(chan struct{}),
+	}
+	queue.cond = sync.NewCond(&queue.lock)
+
+	go queue.run()
+
+	return queue
+}
+
+func (queue *hookQueue) push(event func(Hooks)) {
+	if queue == nil {
+		return
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if queue.closed {
+		return
+	}
+	queue.events = append(queue.events, event)
+	queue.cond.Signal()
+}
+
+func (queue *hookQueue) run() {
+	defer close(queue.done)
+
+	for {
+		queue.lock.Lock()
+		for len(queue.events) == 0 && !queue.closed {
+			queue.cond.Wait()
+		}
+		if len(queue.events) == 0 && queue.closed {
+			queue.lock.Unlock()
+			return
+		}
+		events := queue.events
+		queue.events = nil
+		queue.lock.Unlock()
+
+		for _, event := range events {
+			event(queue.hooks)
+		}
+	}
+}
+
+// close delivers all pending events and stops the queue.
+func (queue *hookQueue) close() {
+	if queue == nil {
+		return
+	}
+
+	queue.lock.Lock()
+	if !queue.closed {
+		queue.closed = true
+		queue.cond.Signal()
+	}
+	queue.lock.Unlock()
+
+	<-queue.done
+}
@@ -0,0 +1,391 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultIndexInterval = 64         // Records between two sparse index entries
+	indexMagic           = 0x58444957 // "WIDX" in little endian
+	indexVersion         = 3          // Version 2 added timestamps, version 3 the flags
+	indexHeaderSize      = 4 + 4 + 4 + 4 + 8 + 8 + 8 + 8 + 8 + 4
+	indexFlagSealed      = 1 << 0 // The segment was sealed with a footer
+	indexEntrySize       = 8 + 8 + 8
+)
+
+// indexEntry points at the record with the given LSN and timestamp.
+type indexEntry struct {
+	lsn       uint64
+	offset    int64
+	timestamp int64
+}
+
+// segmentIndex is the sparse index of a segment: the offset and timestamp of
+// every interval-th record, so a lookup by LSN or time reads at most interval
+// records. The range of an empty segment is firstLSN = lastLSN+1, which keeps
+// lastLSN ordered across segments.
+type segmentIndex struct {
+	path           string
+	firstLSN       uint64
+	lastLSN        uint64
+	firstTimestamp int64
+	lastTimestamp  int64
+	size           int64 // Offset right after the last record
+	entries        []indexEntry
+	sealed         bool // Ended by a footer, so a missing one is corruption
+
+	// Statistics for the footer, only kept for the segment being written
+	minTimestamp int64
+	maxTimestamp int64
+	payloadBytes uint64
+	checksum     uint32 // CRC-32 of the records
+}
+
+func newSegmentIndex(segmentPath string, previousLSN uint64) *segmentIndex {
+	return &segmentIndex{path: segmentPath, firstLSN: previousLSN + 1, lastLSN: previousLSN}
+}
+
+func (index *segmentIndex) empty() bool {
+	return len(index.entries) == 0
+}
+
+func (index *segmentIndex) contains(lsn uint64) bool {
+	return !index.empty() && index.firstLSN <= lsn && lsn <= index.lastLSN
+}
+
+// add records that the record with lsn and timestamp starts at offset and
+// holds payloadSize bytes of data. Records must be added in order.
+func (index *segmentIndex) add(lsn uint64, offset int64, timestamp int64, payloadSize int, interval int) {
+	if !index.empty() && lsn == index.lastLSN {
+		// Another part of the same record, readers start at its first one
+		index.payloadBytes += uint64(payloadSize)
+		return
+	}
+	if index.empty() {
+		index.firstLSN = lsn
+		index.firstTimestamp = timestamp
+		index.minTimestamp = timestamp
+		index.maxTimestamp = timestamp
+	}
+	index.minTimestamp = min(index.minTimestamp, timestamp)
+	index.maxTimestamp = max(index.maxTimestamp, timestamp)
+	index.payloadBytes += uint64(payloadSize)
+	if (lsn-index.firstLSN)%uint64(interval) == 0 {
+		index.entries = append(index.entries, indexEntry{lsn: lsn, offset: offset, timestamp: timestamp})
+	}
+	index.lastLSN = lsn
+	index.lastTimestamp = timestamp
+}
+
+// seek returns the offset of the last indexed record at or before lsn, where
+// a scan for lsn should start.
+func (index *segmentIndex) seek(lsn uint64) int64 {
+	i := sort.Search(len(index.entries), func(i int) bool { return index.entries[i].lsn > lsn })
+	if i == 0 {
+		return 0
+	}
+	return index.entries[i-1].offset
+}
+
+// seekTime returns the last indexed entry written at or before timestamp. The
+// segment's first record must not be newer than timestamp.
+func (index *segmentIndex) seekTime(timestamp int64) indexEntry {
+	i := sort.Search(len(index.entries), func(i int) bool { return index.entries[i].timestamp > timestamp })
+	return index.entries[max(i-1, 0)]
+}
+
+// matchesFooter cross-checks a sidecar against the footer of its segment, so
+// a sidecar left behind for an older segment under the same name is not
+// trusted. Segments sealed before footers existed have none to check, and a
+// damaged footer is left for the scrubber to report.
+func (index *segmentIndex) matchesFooter(fs FS) bool {
+	footer, err := readSegmentFooter(fs, index.path, index.size)
+	if err != nil {
+		return errors.Is(err, ErrNoFooter) || errors.Is(err, ErrCorruptFooter)
+	}
+	return footer.LastLSN == index.lastLSN && (index.empty() || footer.FirstLSN == index.firstLSN)
+}
+
+// hasFooter tells whether the segment was sealed with a footer, even one that
+// is damaged now.
+func (index *segmentIndex) hasFooter(fs FS) bool {
+	_, err := readSegmentFooter(fs, index.path, index.size)
+	return err == nil || errors.Is(err, ErrCorruptFooter)
+}
+
+// buildSegmentIndex scans a segment to index its records. On corruption it
+// returns the index of the valid records along with the error. In segments
+// framed in blocks those include the intact records behind the damage, which
+// are found by resyncing at the next block.
+func buildSegmentIndex(fs FS, segmentPath string, previousLSN uint64, interval int) (*segmentIndex, error) {
+	index := newSegmentIndex(segmentPath, previousLSN)
+
+	reader, err := openSegmentReader(fs, segmentPath, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL segment file: %w", err)
+	}
+	defer reader.close()
+
+	var corruption error // First corruption resynced past
+	var resumed bool     // A record was indexed since the last resync
+	for {
+		record, offset, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrCorruptRecord) && reader.blocks {
+			if corruption == nil {
+				index.size = offset
+				corruption = err
+			}
+			resumed = false
+			resynced, err := reader.resync()
+			if err != nil {
+				return index, err
+			}
+			if !resynced {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			index.size = reader.offset
+			return index, err
+		}
+
+		lsn := record.GetLogSequenceNumber()
+		if corruption != nil {
+			// Behind the damage only records that continue the LSNs count,
+			// the rest are stale ones of a recycled segment or lost parts
+			continuesRecord := resumed && lsn == index.lastLSN && record.GetPart() > 0
+			if !continuesRecord && (index.empty() || lsn <= index.lastLSN || record.GetPart() > 0) {
+				continue
+			}
+			resumed = true
+			index.add(lsn, offset, record.GetTimestamp(), len(record.GetData()), interval)
+			if last := index.entries[len(index.entries)-1]; last.lsn != lsn {
+				// Lookups of the records behind the damage must not start in front of it
+				index.entries = append(index.entries, indexEntry{lsn: lsn, offset: offset, timestamp: record.GetTimestamp()})
+			}
+			index.size = reader.offset
+			continue
+		}
+		index.add(lsn, offset, record.GetTimestamp(), len(record.GetData()), interval)
+		index.checksum = reader.checksum
+	}
+
+	if corruption != nil {
+		return index, corruption
+	}
+	index.size = reader.offset
+	return index, nil
+}
+
+// IndexPrefix starts the names of the sidecars holding segment indexes, which
+// go on with the name of their segment, so they never match a segment glob.
+const IndexPrefix = "index-"
+
+// indexFilePath returns the path of the sidecar holding a segment's index.
+func indexFilePath(segmentPath string) string {
+	name := IndexPrefix + strings.TrimSuffix(filepath.Base(segmentPath), ".log") + ".idx"
+	return filepath.Join(filepath.Dir(segmentPath), name)
+}
+
+// writeIndexFile persists the index of a sealed segment. The sidecar is not
+// fsynced: it is only an accelerator, and a torn or missing one is rebuilt
+// from the segment.
+func writeIndexFile(fs FS, index *segmentIndex, interval int) error {
+	buffer := make([]byte, 0, indexHeaderSize+len(index.entries)*indexEntrySize+4)
+	buffer = binary.LittleEndian.AppendUint32(buffer, indexMagic)
+	buffer = binary.LittleEndian.AppendUint32(buffer, indexVersion)
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(interval))
+	var flags uint32
+	if index.sealed {
+		flags |= indexFlagSealed
+	}
+	buffer = binary.LittleEndian.AppendUint32(buffer, flags)
+	buffer = binary.LittleEndian.AppendUint64(buffer, index.firstLSN)
+	buffer = binary.LittleEndian.AppendUint64(buffer, index.lastLSN)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(index.firstTimestamp))
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(index.lastTimestamp))
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(index.size))
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(index.entries)))
+	for _, entry := range index.entries {
+		buffer = binary.LittleEndian.AppendUint64(buffer, entry.lsn)
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(entry.offset))
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(entry.timestamp))
+	}
+	buffer = binary.LittleEndian.AppendUint32(buffer, crc32.ChecksumIEEE(buffer))
+
+	file, err := fs.OpenFile(indexFilePath(index.path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buffer); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readIndexFile loads the sidecar of a segment, failing when it is missing,
+// damaged or was built with a different interval.
+func readIndexFile(fs FS, segmentPath string, interval int) (*segmentIndex, error) {
+	file, err := fs.OpenFile(indexFilePath(segmentPath), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(buffer) < indexHeaderSize+4 {
+		return nil, fmt.Errorf("index file of %s is truncated", segmentPath)
+	}
+	content, checksum := buffer[:len(buffer)-4], binary.LittleEndian.Uint32(buffer[len(buffer)-4:])
+	if crc32.ChecksumIEEE(content) != checksum {
+		return nil, fmt.Errorf("index file of %s fails its checksum", segmentPath)
+	}
+	if binary.LittleEndian.Uint32(content[0:]) != indexMagic {
+		return nil, fmt.Errorf("index file of %s has a bad magic number", segmentPath)
+	}
+	if binary.LittleEndian.Uint32(content[4:]) != indexVersion {
+		return nil, fmt.Errorf("index file of %s has an unsupported version", segmentPath)
+	}
+	if int(binary.LittleEndian.Uint32(content[8:])) != interval {
+		return nil, fmt.Errorf("index file of %s uses another interval", segmentPath)
+	}
+
+	index := &segmentIndex{
+		path:           segmentPath,
+		firstLSN:       binary.LittleEndian.Uint64(content[16:]),
+		lastLSN:        binary.LittleEndian.Uint64(content[24:]),
+		firstTimestamp: int64(binary.LittleEndian.Uint64(content[32:])),
+		lastTimestamp:  int64(binary.LittleEndian.Uint64(content[40:])),
+		size:           int64(binary.LittleEndian.Uint64(content[48:])),
+		sealed:         binary.LittleEndian.Uint32(content[12:])&indexFlagSealed != 0,
+	}
+	count := int(binary.LittleEndian.Uint32(content[56:]))
+	if len(content) != indexHeaderSize+count*indexEntrySize {
+		return nil, fmt.Errorf("index file of %s has a bad entry count", segmentPath)
+	}
+	index.entries = make([]indexEntry, count)
+	for i := range index.entries {
+		entry := content[indexHeaderSize+i*indexEntrySize:]
+		index.entries[i] = indexEntry{
+			lsn:       binary.LittleEndian.Uint64(entry[0:]),
+			offset:    int64(binary.LittleEndian.Uint64(entry[8:])),
+			timestamp: int64(binary.LittleEndian.Uint64(entry[16:])),
+		}
+	}
+
+	fileInfo, err := fs.Stat(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	if index.size > fileInfo.Size() {
+		return nil, fmt.Errorf("index file of %s does not match the segment", segmentPath)
+	}
+	return index, nil
+}
+
+// loadSegmentIndexes builds the in-memory catalog of segments, from their
+// sidecars where possible, and recovers the last LSN and timestamp written. Sidecars that
+// are missing or damaged are rebuilt by scanning their segment.
+func (wal *WriteAheadLog) loadSegmentIndexes() error {
+	segmentFiles, err := listSegmentFiles(wal.fs, wal.directory, wal.segmentNaming)
+	if err != nil {
+		return err
+	}
+	wal.removeOrphanedIndexFiles(segmentFiles)
+
+	wal.segments = make([]*segmentIndex, 0, len(segmentFiles))
+	var previousLSN uint64
+	for _, segmentFile := range segmentFiles {
+		var index *segmentIndex
+		if segmentFile == wal.currSegmentFile.Name() {
+			// Repaired by loadLastSegmentFile, but may still grow
+			if index, err = buildSegmentIndex(wal.fs, segmentFile, previousLSN, wal.indexInterval); err != nil {
+				if index == nil || !errors.Is(err, ErrCorruptRecord) {
+					return err
+				}
+				// Damage in the middle of a segment framed in blocks, which
+				// the repair kept the intact records behind
+				fmt.Printf("Indexing WAL segment %s skipped damaged records: %v\n", segmentFile, err)
+			}
+		} else if index, err = readIndexFile(wal.fs, segmentFile, wal.indexInterval); err != nil || !index.matchesFooter(wal.fs) {
+			if index, err = buildSegmentIndex(wal.fs, segmentFile, previousLSN, wal.indexInterval); err != nil {
+				if index == nil || !errors.Is(err, ErrCorruptRecord) {
+					return err
+				}
+				// Keep serving the intact records
+				fmt.Printf("Indexing WAL segment %s skipped damaged records: %v\n", segmentFile, err)
+			} else {
+				index.sealed = index.hasFooter(wal.fs)
+				if err := writeIndexFile(wal.fs, index, wal.indexInterval); err != nil {
+					fmt.Printf("Error writing WAL index for %s: %v\n", segmentFile, err)
+				}
+			}
+		}
+
+		if index.empty() {
+			index.firstLSN, index.lastLSN = previousLSN+1, previousLSN
+		} else {
+			wal.lastTimestamp = index.lastTimestamp
+		}
+		previousLSN = index.lastLSN
+		wal.segments = append(wal.segments, index)
+	}
+
+	wal.lastLogSequenceNumber = previousLSN
+	return nil
+}
+
+// removeOrphanedIndexFiles deletes sidecars whose segment is gone, e.g.
+// because a crash hit between deleting the two.
+func (wal *WriteAheadLog) removeOrphanedIndexFiles(segmentFiles []string) {
+	indexFiles, err := wal.fs.Glob(filepath.Join(wal.directory, IndexPrefix+strings.TrimSuffix(wal.segmentNaming.pattern(), ".log")+".idx"))
+	if err != nil {
+		return
+	}
+	for _, indexFile := range indexFiles {
+		if !slices.ContainsFunc(segmentFiles, func(segmentFile string) bool { return indexFilePath(segmentFile) == indexFile }) {
+			wal.fs.Remove(indexFile)
+		}
+	}
+}
+
+// currentIndex returns the index of the segment being written.
+func (wal *WriteAheadLog) currentIndex() *segmentIndex {
+	return wal.segments[len(wal.segments)-1]
+}
+
+// findSegment returns the index of the segment holding lsn, or nil.
+func (wal *WriteAheadLog) findSegment(lsn uint64) *segmentIndex {
+	i := sort.Search(len(wal.segments), func(i int) bool { return wal.segments[i].lastLSN >= lsn })
+	if i == len(wal.segments) || !wal.segments[i].contains(lsn) {
+		return nil
+	}
+	return wal.segments[i]
+}
+
+// dropSegmentIndex forgets a segment that was deleted or recycled and removes
+// its sidecar. Should a crash leave the sidecar behind, the next start removes
+// it.
+func (wal *WriteAheadLog) dropSegmentIndex(segmentPath string) {
+	if err := wal.fs.Remove(indexFilePath(segmentPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Error removing WAL index for %s: %v\n", segmentPath, err)
+	}
+	wal.segments = slices.DeleteFunc(wal.segments, func(index *segmentIndex) bool { return index.path == segmentPath })
+}
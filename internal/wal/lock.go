@@ -0,0 +1,38 @@
+package wal
+
+import (
+	"context"
+)
+
+// contextMutex is a mutex whose Lock can be abandoned when a context ends.
+// Unlike sync.Mutex its zero value is not usable, create it with
+// newContextMutex.
+type contextMutex chan struct{}
+
+func newContextMutex() contextMutex {
+	return make(contextMutex, 1)
+}
+
+func (mutex contextMutex) Lock() {
+	mutex <- struct{}{}
+}
+
+// LockContext acquires the mutex, or returns the context's error if it ends
+// first.
+func (mutex contextMutex) LockContext(ctx context.Context) error {
+	// Prefer reporting an ended context over taking a free lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case mutex <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (mutex contextMutex) Unlock() {
+	<-mutex
+}
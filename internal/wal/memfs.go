@@ -0,0 +1,401 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrCrashed is returned by file handles that were open when MemFS.Crash ran.
+var ErrCrashed = errors.New("file handle invalidated by simulated crash")
+
+// MemFS is an in-memory FS. Besides making tests fast it remembers what was
+// fsynced, file contents as well as directory entries, so Crash can throw away
+// everything a power loss would.
+type MemFS struct {
+	lock       sync.Mutex
+	files      map[string]*memNode
+	durable    map[string]*memNode // Directory entries as of the last SyncDir of their directory
+	dirs       map[string]bool
+	generation int // Bumped by Crash to invalidate open handles
+}
+
+type memNode struct {
+	data    []byte    // Contents as seen by readers
+	synced  []byte    // Contents as of the last Sync, what survives a crash
+	modTime time.Time // Time of the last write
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:   make(map[string]*memNode),
+		durable: make(map[string]*memNode),
+		dirs:    map[string]bool{string(filepath.Separator): true, ".": true},
+	}
+}
+
+func (memFS *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	name = filepath.Clean(name)
+	node, exists := memFS.files[name]
+
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !exists:
+		if !memFS.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		memFS.files[name] = node
+	}
+
+	if flag&os.O_TRUNC != 0 && isWritable(flag) {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &memFile{
+		memFS:      memFS,
+		node:       node,
+		name:       name,
+		flag:       flag,
+		generation: memFS.generation,
+	}, nil
+}
+
+func (memFS *MemFS) Remove(name string) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if _, exists := memFS.files[name]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(memFS.files, name)
+	return nil
+}
+
+func (memFS *MemFS) Rename(oldPath, newPath string) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	node, exists := memFS.files[oldPath]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	if !memFS.dirs[filepath.Dir(newPath)] {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	delete(memFS.files, oldPath)
+	memFS.files[newPath] = node
+	return nil
+}
+
+func (memFS *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	for dir := filepath.Clean(path); !memFS.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, exists := memFS.files[dir]; exists {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		memFS.dirs[dir] = true
+	}
+	return nil
+}
+
+func (memFS *MemFS) Glob(pattern string) ([]string, error) {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	var matches []string
+	for name := range memFS.files {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (memFS *MemFS) Stat(name string) (os.FileInfo, error) {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if node, exists := memFS.files[name]; exists {
+		return &memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if memFS.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), isDir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (memFS *MemFS) SyncDir(dir string) error {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !memFS.dirs[dir] {
+		return &os.PathError{Op: "sync", Path: dir, Err: os.ErrNotExist}
+	}
+	for name := range memFS.durable {
+		if filepath.Dir(name) == dir {
+			delete(memFS.durable, name)
+		}
+	}
+	for name, node := range memFS.files {
+		if filepath.Dir(name) == dir {
+			memFS.durable[name] = node
+		}
+	}
+	return nil
+}
+
+// Crash simulates a power loss: directory entries are reset to their last
+// synced state, every file to its last synced contents, and all open handles
+// start failing with ErrCrashed.
+func (memFS *MemFS) Crash() {
+	memFS.CrashTorn(func(name string, unsynced int) int { return 0 })
+}
+
+// CrashTorn simulates a power loss where part of the un-fsynced data made it to
+// disk anyway. keep returns how many of the unsynced bytes of a file survive.
+func (memFS *MemFS) CrashTorn(keep func(name string, unsynced int) int) {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	memFS.files = make(map[string]*memNode, len(memFS.durable))
+	for name, node := range memFS.durable {
+		memFS.files[name] = node
+	}
+
+	for name, node := range memFS.files {
+		survived := append([]byte(nil), node.synced...)
+		if len(node.data) > len(node.synced) && bytes.HasPrefix(node.data, node.synced) {
+			unsynced := node.data[len(node.synced):]
+			survived = append(survived, unsynced[:keep(name, len(unsynced))]...)
+		}
+		node.data = survived
+	}
+	memFS.generation++
+}
+
+// ReadFile returns a copy of the current contents of a file.
+func (memFS *MemFS) ReadFile(name string) ([]byte, error) {
+	memFS.lock.Lock()
+	defer memFS.lock.Unlock()
+
+	node, exists := memFS.files[filepath.Clean(name)]
+	if !exists {
+		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), node.data...), nil
+}
+
+// WriteFile replaces the contents of a file, marking them and the directory
+// entry as synced.
+func (memFS *MemFS) WriteFile(name string, data []byte) error {
+	file, err := memFS.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return memFS.SyncDir(filepath.Dir(name))
+}
+
+func isWritable(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+type memFile struct {
+	memFS      *MemFS
+	node       *memNode
+	name       string
+	flag       int
+	offset     int64
+	closed     bool
+	generation int
+}
+
+// check must be called with the MemFS lock held.
+func (file *memFile) check(op string) error {
+	if file.closed {
+		return &os.PathError{Op: op, Path: file.name, Err: os.ErrClosed}
+	}
+	if file.generation != file.memFS.generation {
+		return &os.PathError{Op: op, Path: file.name, Err: ErrCrashed}
+	}
+	return nil
+}
+
+func (file *memFile) Name() string {
+	return file.name
+}
+
+func (file *memFile) Read(buffer []byte) (int, error) {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("read"); err != nil {
+		return 0, err
+	}
+	if file.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: file.name, Err: os.ErrPermission}
+	}
+	if file.offset >= int64(len(file.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buffer, file.node.data[file.offset:])
+	file.offset += int64(n)
+	return n, nil
+}
+
+func (file *memFile) Write(buffer []byte) (int, error) {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("write"); err != nil {
+		return 0, err
+	}
+	if !isWritable(file.flag) {
+		return 0, &os.PathError{Op: "write", Path: file.name, Err: os.ErrPermission}
+	}
+	if file.flag&os.O_APPEND != 0 {
+		file.offset = int64(len(file.node.data))
+	}
+	// Like the kernel, reject O_DIRECT writes that are not block aligned
+	if file.flag&directFlag != 0 && (file.offset%directBlockSize != 0 || len(buffer)%directBlockSize != 0) {
+		return 0, &os.PathError{Op: "write", Path: file.name, Err: syscall.EINVAL}
+	}
+
+	end := file.offset + int64(len(buffer))
+	if end > int64(len(file.node.data)) {
+		file.node.data = append(file.node.data, make([]byte, end-int64(len(file.node.data)))...)
+	}
+	copy(file.node.data[file.offset:], buffer)
+	file.offset = end
+	file.node.modTime = time.Now()
+	if file.flag&dsyncFlag != 0 {
+		file.node.synced = append(file.node.synced[:0], file.node.data...)
+	}
+	return len(buffer), nil
+}
+
+func (file *memFile) Seek(offset int64, whence int) (int64, error) {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("seek"); err != nil {
+		return 0, err
+	}
+
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = file.offset + offset
+	case io.SeekEnd:
+		position = int64(len(file.node.data)) + offset
+	}
+	if position < 0 {
+		return 0, &os.PathError{Op: "seek", Path: file.name, Err: os.ErrInvalid}
+	}
+	file.offset = position
+	return position, nil
+}
+
+func (file *memFile) Stat() (os.FileInfo, error) {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("stat"); err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: filepath.Base(file.name), size: int64(len(file.node.data)), modTime: file.node.modTime}, nil
+}
+
+func (file *memFile) Sync() error {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("sync"); err != nil {
+		return err
+	}
+	file.node.synced = append(file.node.synced[:0], file.node.data...)
+	return nil
+}
+
+func (file *memFile) Truncate(size int64) error {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("truncate"); err != nil {
+		return err
+	}
+	if !isWritable(file.flag) || size < 0 {
+		return &os.PathError{Op: "truncate", Path: file.name, Err: os.ErrInvalid}
+	}
+	resized := make([]byte, size)
+	copy(resized, file.node.data)
+	file.node.data = resized
+	file.node.modTime = time.Now()
+	return nil
+}
+
+func (file *memFile) Close() error {
+	file.memFS.lock.Lock()
+	defer file.memFS.lock.Unlock()
+
+	if err := file.check("close"); err != nil {
+		return err
+	}
+	file.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (info *memFileInfo) Name() string       { return info.name }
+func (info *memFileInfo) Size() int64        { return info.size }
+func (info *memFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memFileInfo) IsDir() bool        { return info.isDir }
+func (info *memFileInfo) Sys() any           { return nil }
+
+func (info *memFileInfo) Mode() os.FileMode {
+	if info.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
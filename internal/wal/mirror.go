@@ -0,0 +1,650 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	pb "walstore/proto"
+)
+
+// ErrQuorumLost is returned for writes that could not be made durable on
+// enough mirrors.
+var ErrQuorumLost = errors.New("not enough healthy WAL mirrors")
+
+// errRepairing keeps reads and writes away from a mirror while it is rebuilt.
+var errRepairing = errors.New("mirror is being repaired")
+
+// MirrorConfig configures a MirroredWAL.
+type MirrorConfig struct {
+	Mirrors     []*Config // One WAL per directory, ideally on different disks
+	WriteQuorum int       // Mirrors a write has to be durable on before it is acknowledged, 0 for all of them
+}
+
+// MirroredWAL writes every record to two or more WriteAheadLogs. The mirrors
+// agree on the LSN and data of every record, but each stamps and lays out the
+// records itself, so their timestamps and segment files differ.
+//
+// A mirror a write fails on falls behind and gets no more writes until it is
+// repaired. Reads and scrubs fall back to another mirror when a copy is
+// corrupt.
+type MirroredWAL struct {
+	lock    sync.Mutex // Orders appends, so every mirror assigns the same LSNs
+	mirrors []*mirror
+	quorum  int
+	lastLSN uint64 // LSN of the last record appended, a healthy mirror that assigns another one fails
+}
+
+type mirror struct {
+	config *Config
+	lock   sync.Mutex     // Guards wal and failed
+	wal    *WriteAheadLog // nil when the mirror could not be started
+	failed error          // Why the mirror gets no writes, nil while it is healthy
+}
+
+// healthyWAL returns the WAL of the mirror, nil when it failed.
+func (mirror *mirror) healthyWAL() *WriteAheadLog {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	if mirror.failed != nil {
+		return nil
+	}
+	return mirror.wal
+}
+
+func (mirror *mirror) fail(err error) {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	if mirror.failed == nil {
+		fmt.Printf("WAL mirror %s failed and gets no more writes until it is repaired: %v\n", mirror.config.Directory, err)
+		mirror.failed = err
+	}
+}
+
+// StartMirroredLogger starts the WAL of every mirror. Mirrors that fell
+// behind, because of a crash or a failed write, are caught up with the most
+// advanced one; mirrors that can not be caught up or started are marked failed
+// until Repair rebuilds them.
+func StartMirroredLogger(config *MirrorConfig) (*MirroredWAL, error) {
+	if len(config.Mirrors) < 2 {
+		return nil, fmt.Errorf("a mirrored WAL needs at least 2 mirrors, got %d", len(config.Mirrors))
+	}
+	if config.WriteQuorum < 0 || config.WriteQuorum > len(config.Mirrors) {
+		return nil, fmt.Errorf("write quorum must be between 0 and %d, got %d", len(config.Mirrors), config.WriteQuorum)
+	}
+	directories := make(map[string]bool, len(config.Mirrors))
+	for _, mirrorConfig := range config.Mirrors {
+		directory := filepath.Clean(mirrorConfig.Directory)
+		if directories[directory] {
+			return nil, fmt.Errorf("directory %s is used by more than one mirror", directory)
+		}
+		directories[directory] = true
+	}
+
+	mirrored := &MirroredWAL{quorum: config.WriteQuorum}
+	if mirrored.quorum == 0 {
+		mirrored.quorum = len(config.Mirrors)
+	}
+	for _, mirrorConfig := range config.Mirrors {
+		mirror := &mirror{config: mirrorConfig}
+		if mirror.wal, mirror.failed = StartLogger(mirrorConfig); mirror.failed != nil {
+			fmt.Printf("Error starting WAL mirror %s: %v\n", mirrorConfig.Directory, mirror.failed)
+		}
+		mirrored.mirrors = append(mirrored.mirrors, mirror)
+	}
+	if mirrored.healthyCount() == 0 {
+		return nil, fmt.Errorf("%w: no mirror could be started", ErrQuorumLost)
+	}
+
+	mirrored.catchUp()
+	return mirrored, nil
+}
+
+// catchUp brings the healthy mirrors level with the most advanced one: the
+// records they share have to match, and those they miss are copied over.
+func (mirrored *MirroredWAL) catchUp() {
+	var leader *WriteAheadLog
+	for _, mirror := range mirrored.mirrors {
+		if wal := mirror.healthyWAL(); wal != nil && (leader == nil || wal.lastLogSequenceNumber > leader.lastLogSequenceNumber) {
+			leader = wal
+		}
+	}
+
+	for _, mirror := range mirrored.mirrors {
+		wal := mirror.healthyWAL()
+		if wal == nil || wal == leader {
+			continue
+		}
+		if err := compareRecords(leader, wal); errors.Is(err, ErrCorruptRecord) {
+			// Reads fall back to the intact copy, scrubs report the damage
+			fmt.Printf("Error comparing WAL mirror %s with %s: %v\n", mirror.config.Directory, leader.directory, err)
+		} else if err != nil {
+			mirror.fail(fmt.Errorf("failed to catch up: %w", err))
+			continue
+		}
+		if wal.lastLogSequenceNumber == leader.lastLogSequenceNumber {
+			continue
+		}
+		fmt.Printf("Catching up WAL mirror %s from lsn %d to %d\n", mirror.config.Directory, wal.lastLogSequenceNumber, leader.lastLogSequenceNumber)
+		if err := copyRecords(leader, wal); err != nil {
+			mirror.fail(fmt.Errorf("failed to catch up: %w", err))
+		}
+	}
+	mirrored.lastLSN = leader.lastLogSequenceNumber
+}
+
+// compareRecords checks that the records both WALs still hold have the same
+// data.
+func compareRecords(source *WriteAheadLog, target *WriteAheadLog) error {
+	from := max(source.oldestLSN(), target.oldestLSN())
+	to := min(source.lastLogSequenceNumber, target.lastLogSequenceNumber)
+	if from > to {
+		return nil
+	}
+
+	sourceIterator, err := source.Iterate(from)
+	if err != nil {
+		return err
+	}
+	defer sourceIterator.Close()
+	targetIterator, err := target.Iterate(from)
+	if err != nil {
+		return err
+	}
+	defer targetIterator.Close()
+
+	for lsn := from; lsn <= to; lsn++ {
+		sourceRecord, err := sourceIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read lsn %d from %s: %w", lsn, source.directory, err)
+		}
+		targetRecord, err := targetIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read lsn %d from %s: %w", lsn, target.directory, err)
+		}
+		if sourceRecord.GetLogSequenceNumber() != lsn || targetRecord.GetLogSequenceNumber() != lsn {
+			return fmt.Errorf("%w: %d is no longer in the WAL", ErrLSNNotFound, lsn)
+		}
+		if !bytes.Equal(sourceRecord.GetData(), targetRecord.GetData()) {
+			return fmt.Errorf("lsn %d holds other data than on %s", lsn, source.directory)
+		}
+	}
+	return nil
+}
+
+// oldestLSN returns the LSN of the first record the WAL still holds.
+func (wal *WriteAheadLog) oldestLSN() uint64 {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.segments[0].firstLSN
+}
+
+// copyRecords appends the records of source that come after the last record
+// of target to target.
+func copyRecords(source *WriteAheadLog, target *WriteAheadLog) error {
+	from := target.lastLogSequenceNumber + 1
+	iterator, err := source.Iterate(from)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			return target.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		if record.GetLogSequenceNumber() != from {
+			return fmt.Errorf("%w: %d is no longer in the WAL", ErrLSNNotFound, from)
+		}
+		if err := target.WriteRecord(record.GetData()); err != nil {
+			return err
+		}
+		from++
+	}
+}
+
+func (mirrored *MirroredWAL) healthyCount() int {
+	count := 0
+	for _, mirror := range mirrored.mirrors {
+		if mirror.healthyWAL() != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Health returns, for every mirror in the order of MirrorConfig.Mirrors, why
+// it gets no writes, or nil when it is healthy.
+func (mirrored *MirroredWAL) Health() []error {
+	health := make([]error, len(mirrored.mirrors))
+	for i, mirror := range mirrored.mirrors {
+		mirror.lock.Lock()
+		health[i] = mirror.failed
+		mirror.lock.Unlock()
+	}
+	return health
+}
+
+func (mirrored *MirroredWAL) WriteRecord(data []byte) error {
+	return mirrored.WriteRecordContext(context.Background(), data)
+}
+
+// WriteRecordContext writes data to every healthy mirror and waits until it
+// is durable on the write quorum. Mirrors the write fails on, or that assign
+// it another LSN, are marked failed, also after ctx ended. It gives up when
+// ctx ends, in which case the record may still become durable.
+func (mirrored *MirroredWAL) WriteRecordContext(ctx context.Context, data []byte) error {
+	mirrored.lock.Lock()
+	var mirrors []*mirror
+	var wals []*WriteAheadLog
+	for _, mirror := range mirrored.mirrors {
+		if wal := mirror.healthyWAL(); wal != nil {
+			mirrors = append(mirrors, mirror)
+			wals = append(wals, wal)
+		}
+	}
+	if len(mirrors) < mirrored.quorum {
+		mirrored.lock.Unlock()
+		return fmt.Errorf("%w: %d of %d mirrors are healthy, %d needed", ErrQuorumLost, len(mirrors), len(mirrored.mirrors), mirrored.quorum)
+	}
+	// Mirrors can still be writing data once the quorum acknowledged it or
+	// ctx ended, so they get a copy the caller can not change under them
+	data = bytes.Clone(data)
+	futures := make([]*AppendFuture, len(wals))
+	for i, wal := range wals {
+		futures[i] = wal.AppendAsync(data)
+	}
+	mirrored.lastLSN++
+	logSeqNumber := mirrored.lastLSN
+	mirrored.lock.Unlock()
+
+	// Buffered, the mirrors still report once the caller gave up
+	results := make(chan error, len(mirrors))
+	for i, mirror := range mirrors {
+		go func() {
+			err := waitMirrorDurable(ctx, wals[i], futures[i], logSeqNumber)
+			if err != nil && (ctx.Err() == nil || !errors.Is(err, ctx.Err())) {
+				mirror.fail(err)
+			}
+			results <- err
+		}()
+	}
+
+	var durable int
+	var errs []error
+	for range mirrors {
+		var err error
+		select {
+		case err = <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err == nil {
+			if durable++; durable == mirrored.quorum {
+				return nil
+			}
+			continue
+		}
+		errs = append(errs, err)
+		if len(mirrors)-len(errs) < mirrored.quorum {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrQuorumLost, errors.Join(errs...))
+}
+
+// waitMirrorDurable waits until a record appended to a mirror was written as
+// logSeqNumber and synced. The write is waited for even once ctx ended, so a
+// mirror it failed on is always found out.
+func waitMirrorDurable(ctx context.Context, wal *WriteAheadLog, future *AppendFuture, logSeqNumber uint64) error {
+	written, err := future.Wait()
+	if err != nil {
+		return err
+	}
+	if written != logSeqNumber {
+		return fmt.Errorf("record was written as lsn %d instead of %d", written, logSeqNumber)
+	}
+	return wal.syncThrough(ctx, logSeqNumber)
+}
+
+// Sync syncs every healthy mirror and fails with ErrQuorumLost when less than
+// the write quorum succeeded.
+func (mirrored *MirroredWAL) Sync() error {
+	synced := 0
+	var errs []error
+	for _, mirror := range mirrored.mirrors {
+		wal := mirror.healthyWAL()
+		if wal == nil {
+			continue
+		}
+		if err := wal.Sync(); err != nil {
+			mirror.fail(err)
+			errs = append(errs, err)
+			continue
+		}
+		synced++
+	}
+	if synced < mirrored.quorum {
+		return fmt.Errorf("%w: %w", ErrQuorumLost, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Close closes the WAL of every mirror, failed ones included.
+func (mirrored *MirroredWAL) Close() error {
+	mirrored.lock.Lock()
+	defer mirrored.lock.Unlock()
+
+	var errs []error
+	for _, mirror := range mirrored.mirrors {
+		if mirror.wal == nil {
+			continue
+		}
+		if err := mirror.wal.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close WAL mirror %s: %w", mirror.config.Directory, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// read calls read with the healthy mirrors in turn until it does not fail
+// with ErrCorruptRecord.
+func (mirrored *MirroredWAL) read(read func(wal *WriteAheadLog) error) error {
+	var firstErr error
+	for _, mirror := range mirrored.mirrors {
+		wal := mirror.healthyWAL()
+		if wal == nil {
+			continue
+		}
+		err := read(wal)
+		if !errors.Is(err, ErrCorruptRecord) {
+			return err
+		}
+		fmt.Printf("Error reading WAL mirror %s, falling back to the next mirror: %v\n", mirror.config.Directory, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return fmt.Errorf("%w: no mirror is healthy", ErrQuorumLost)
+	}
+	return firstErr
+}
+
+// ReadAt returns the record with the given log sequence number from the first
+// mirror holding an intact copy.
+func (mirrored *MirroredWAL) ReadAt(lsn uint64) (*pb.WalRecord, error) {
+	var record *pb.WalRecord
+	err := mirrored.read(func(wal *WriteAheadLog) (err error) {
+		record, err = wal.ReadAt(lsn)
+		return err
+	})
+	return record, err
+}
+
+// ReadRange returns the records from from to to, both included, from the
+// first mirror holding an intact copy of all of them.
+func (mirrored *MirroredWAL) ReadRange(from uint64, to uint64) ([]*pb.WalRecord, error) {
+	var records []*pb.WalRecord
+	err := mirrored.read(func(wal *WriteAheadLog) (err error) {
+		records, err = wal.ReadRange(from, to)
+		return err
+	})
+	return records, err
+}
+
+// ReadAllRecords reads the records of the current segment from the first
+// mirror holding an intact copy of them, see WriteAheadLog.ReadAllRecords.
+func (mirrored *MirroredWAL) ReadAllRecords() ([]*pb.WalRecord, error) {
+	var records []*pb.WalRecord
+	err := mirrored.read(func(wal *WriteAheadLog) (err error) {
+		records, err = wal.ReadAllRecords()
+		return err
+	})
+	return records, err
+}
+
+// ReadAllSegments reads every record from the first mirror holding an intact
+// copy of all of them.
+func (mirrored *MirroredWAL) ReadAllSegments() ([]*pb.WalRecord, error) {
+	var records []*pb.WalRecord
+	err := mirrored.read(func(wal *WriteAheadLog) (err error) {
+		records, err = wal.ReadAllSegments()
+		return err
+	})
+	return records, err
+}
+
+// Scrub scrubs the sealed segments of every healthy mirror, see
+// WriteAheadLog.Scrub. Corrupt segments are reported to the Hooks of their
+// mirror, but only fail the scrub when no other mirror holds an intact copy of
+// their records; Repair rebuilds a mirror from a healthy one.
+func (mirrored *MirroredWAL) Scrub(ctx context.Context) error {
+	var errs []error
+	for _, mirror := range mirrored.mirrors {
+		wal := mirror.healthyWAL()
+		if wal == nil {
+			continue
+		}
+		corruptSegments, err := wal.scrub(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+
+		for _, segment := range corruptSegments {
+			if segment.FirstLSN == 0 || mirrored.hasIntactCopy(wal, segment) {
+				fmt.Printf("WAL mirror %s has a corrupt segment %s, its records are intact on another mirror\n", mirror.config.Directory, segment.Path)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%w: lsn %d to %d of segment %s have no intact copy", ErrCorruptRecord, segment.FirstLSN, segment.LastLSN, segment.Path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hasIntactCopy reports whether a healthy mirror other than corrupt can read
+// every record of the segment.
+func (mirrored *MirroredWAL) hasIntactCopy(corrupt *WriteAheadLog, segment SegmentInfo) bool {
+	for _, mirror := range mirrored.mirrors {
+		wal := mirror.healthyWAL()
+		if wal == nil || wal == corrupt {
+			continue
+		}
+		records, err := wal.ReadRange(segment.FirstLSN, segment.LastLSN)
+		if err == nil && uint64(len(records)) == segment.LastLSN-segment.FirstLSN+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Repair rebuilds the mirror at index i of MirrorConfig.Mirrors from a healthy
+// mirror and makes it healthy again. Writes wait until it is done.
+func (mirrored *MirroredWAL) Repair(i int) error {
+	if i < 0 || i >= len(mirrored.mirrors) {
+		return fmt.Errorf("no mirror %d", i)
+	}
+
+	mirrored.lock.Lock()
+	defer mirrored.lock.Unlock()
+
+	target := mirrored.mirrors[i]
+	var source *WriteAheadLog
+	var sourceConfig *Config
+	for _, mirror := range mirrored.mirrors {
+		if wal := mirror.healthyWAL(); wal != nil && mirror != target {
+			source, sourceConfig = wal, mirror.config
+			break
+		}
+	}
+	if source == nil {
+		return fmt.Errorf("%w: no healthy mirror to repair %s from", ErrQuorumLost, target.config.Directory)
+	}
+
+	target.lock.Lock()
+	targetWAL := target.wal
+	target.wal, target.failed = nil, errRepairing
+	target.lock.Unlock()
+
+	if targetWAL != nil {
+		if err := targetWAL.Close(); err != nil {
+			fmt.Printf("Error closing WAL mirror %s for repair: %v\n", target.config.Directory, err)
+		}
+	}
+	// Nothing is written while we hold the lock, make the source complete on disk
+	if err := source.Sync(); err != nil {
+		target.fail(err)
+		return fmt.Errorf("failed to sync WAL mirror %s: %w", sourceConfig.Directory, err)
+	}
+
+	err := RebuildMirror(sourceConfig, target.config)
+	var wal *WriteAheadLog
+	if err == nil {
+		wal, err = StartLogger(target.config)
+	}
+	if err == nil && wal.lastLogSequenceNumber != source.lastLogSequenceNumber {
+		wal.Close()
+		err = fmt.Errorf("repaired mirror ends at lsn %d instead of %d", wal.lastLogSequenceNumber, source.lastLogSequenceNumber)
+	}
+	// Read every record back, so a copy missing parts or blobs is not taken
+	if err == nil {
+		if _, err = wal.ReadAllSegments(); err != nil {
+			wal.Close()
+		}
+	}
+
+	target.lock.Lock()
+	defer target.lock.Unlock()
+	if err != nil {
+		target.failed = fmt.Errorf("failed to repair: %w", err)
+		return fmt.Errorf("failed to repair WAL mirror %s: %w", target.config.Directory, err)
+	}
+	target.wal, target.failed = wal, nil
+	return nil
+}
+
+// RebuildMirror replaces the segments and blob files of the WAL in
+// target.Directory with a copy of those in source.Directory, once the records
+// of the segments checked out.
+// Neither WAL may be running; MirroredWAL.Repair rebuilds a running mirror.
+func RebuildMirror(source *Config, target *Config) error {
+	sourceFS, targetFS := source.FS, target.FS
+	if sourceFS == nil {
+		sourceFS = OSFS{}
+	}
+	if targetFS == nil {
+		targetFS = OSFS{}
+	}
+	if source.SegmentNaming != target.SegmentNaming {
+		return fmt.Errorf("source and target mirror name their segments differently")
+	}
+
+	sourceFiles, err := listSegmentFiles(sourceFS, source.Directory, source.SegmentNaming)
+	if err != nil {
+		return err
+	}
+	if len(sourceFiles) == 0 {
+		return fmt.Errorf("source mirror %s has no segments", source.Directory)
+	}
+	for i, sourceFile := range sourceFiles {
+		// The current segment can have a torn tail, which starting the WAL cuts off
+		if _, _, err := scanSegment(sourceFS, sourceFile, -1); err != nil && !(i == len(sourceFiles)-1 && errors.Is(err, ErrCorruptRecord)) {
+			return fmt.Errorf("source mirror is damaged: %w", err)
+		}
+	}
+
+	if err := targetFS.MkdirAll(target.Directory, 0755); err != nil {
+		return err
+	}
+	// Stale segments of the other naming would be migrated into the copy
+	var targetFiles []string
+	for _, naming := range []SegmentNaming{SegmentNamingCounter, SegmentNamingBaseLSN} {
+		files, err := listSegmentFiles(targetFS, target.Directory, naming)
+		if err != nil {
+			return err
+		}
+		targetFiles = append(targetFiles, files...)
+	}
+	for _, targetFile := range targetFiles {
+		for _, path := range []string{targetFile, indexFilePath(targetFile)} {
+			if err := targetFS.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+		}
+	}
+	// The blob files of the target belong to its own segments
+	targetBlobFiles, _, err := listBlobFiles(targetFS, target.Directory)
+	if err != nil {
+		return err
+	}
+	for _, targetBlobFile := range targetBlobFiles {
+		if err := targetFS.Remove(targetBlobFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", targetBlobFile, err)
+		}
+	}
+
+	// Blob files go first, so no copied segment points into a missing one
+	sourceBlobFiles, _, err := listBlobFiles(sourceFS, source.Directory)
+	if err != nil {
+		return err
+	}
+	for _, sourceBlobFile := range sourceBlobFiles {
+		if err := copyFile(sourceFS, sourceBlobFile, targetFS, filepath.Join(target.Directory, filepath.Base(sourceBlobFile))); err != nil {
+			return err
+		}
+	}
+	for _, sourceFile := range sourceFiles {
+		targetFile := filepath.Join(target.Directory, filepath.Base(sourceFile))
+		if err := copyFile(sourceFS, sourceFile, targetFS, targetFile); err != nil {
+			return err
+		}
+		// Sidecar indexes only save rebuilding them, they may be missing
+		err := copyFile(sourceFS, indexFilePath(sourceFile), targetFS, indexFilePath(targetFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return targetFS.SyncDir(target.Directory)
+}
+
+// copyFile copies a file through a temporary file, so a crash never leaves a
+// partial copy behind under the target name.
+func copyFile(sourceFS FS, sourcePath string, targetFS FS, targetPath string) error {
+	sourceFile, err := sourceFS.OpenFile(sourcePath, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	tempPath := targetPath + ".tmp"
+	targetFile, err := targetFS.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(targetFile, sourceFile); err != nil {
+		targetFile.Close()
+		return fmt.Errorf("failed to copy %s: %w", sourcePath, err)
+	}
+	if err := targetFile.Sync(); err != nil {
+		targetFile.Close()
+		return err
+	}
+	if err := targetFile.Close(); err != nil {
+		return err
+	}
+	return targetFS.Rename(tempPath, targetPath)
+}
@@ -1,24 +1,73 @@
 package wal
 
 import (
-	"bufio"
 	"context"
-	"os"
+	"hash"
 	"sync"
 	"time"
+	pb "walstore/proto"
 )
 
 type WriteAheadLog struct {
 	directory             string        // Directory where WAL segments are stored
-	currSegmentFile       *os.File      // Current segment file being written to
-	bufferWriter          *bufio.Writer // Buffered writer for efficient writing
-	currSegmentNumber     int           // Current segment number for naming segments
+	fs                    FS            // File system holding the segments
+	currSegmentFile       File          // Current segment file being written to
+	bufferWriter          segmentWriter // Buffered writer for efficient writing
+	currSegmentNumber     uint64        // Current segment number for naming segments, the base LSN with SegmentNamingBaseLSN
+	currSegmentSize       int64         // Logical size of the current segment, including buffered bytes
 	lastLogSequenceNumber uint64        // Last log sequence number written
 	maxFileSize           int64         // Maximum size of a segment file
 	maxSegments           int           // Maximum number of segment files to keep
-	lock                  sync.Mutex    // Mutex to protect concurrent access to the WAL
-	syncTimer             *time.Timer   // Timer for periodic flushing of the buffer
+	maxSegmentAge         time.Duration // Age by the clock after which sealed segments are deleted, 0 to keep them
+	preallocate           bool          // Reserve maxFileSize bytes for every new segment
+	recycleSegments       bool          // Reuse segments dropped by retention instead of deleting them
+	syncMode              SyncMode      // How writes are made durable
+	lock                  contextMutex  // Mutex to protect concurrent access to the WAL
+	clock                 Clock         // Source of time for timers and timestamps
+	syncInterval          time.Duration // Interval between periodic syncs
+	syncTimer             Timer         // Timer for periodic flushing of the buffer
 	shouldForceSync       bool          // Flag to force sync on next write
 	context               context.Context
 	cancel                context.CancelFunc // To cancel the background sync task
+	hooks                 *hookQueue         // Delivers lifecycle events, nil when no hooks are configured
+	lastSyncedLSN         uint64             // Last log sequence number covered by a sync
+	syncErr               error              // First failed sync, returned by every later one
+	scratchRecord         pb.WalRecord       // Reused by WriteRecord to avoid allocating a record per write
+	scratchBuffer         []byte             // Reused by WriteRecord to encode the length header and record
+	appendQueue           chan *AppendFuture // Records queued by AppendAsync for the writer goroutine
+	appendLock            sync.RWMutex       // Guards appendClosed and closing appendQueue
+	appendClosed          bool               // Set by Close, AppendAsync fails from then on
+	writerDone            chan struct{}      // Closed when the writer goroutine exits
+	pendingDurable        []*AppendFuture    // Written futures waiting for the next sync
+	maxInFlightBytes      int64              // Unsynced bytes allowed before writers are held back, 0 for no limit
+	rejectWhenFull        bool               // Fail writes with ErrBackpressure instead of syncing when over maxInFlightBytes
+	unsyncedBytes         int64              // Bytes written since the last sync
+	segments              []*segmentIndex    // Sparse index of every segment, oldest first, the last one is current
+	indexInterval         int                // Records between two sparse index entries
+	segmentNaming         SegmentNaming      // How segment files are named
+	monotonicTimestamps   bool               // Stamp records with a hybrid logical clock instead of the plain clock
+	lastTimestamp         int64              // Timestamp of the last record written
+	codec                 Codec              // Compresses record data, nil to store it raw
+	compressionThreshold  int                // Records smaller than this are stored raw
+	compressBuffer        []byte             // Reused to compress records
+	ciphers               *cipherCache       // Encrypts records, nil to store them in plaintext
+	encryptBuffer         []byte             // Reused to encrypt records
+	chainHasher           hash.Hash          // Links every record to the previous one, nil when the hash chain is off
+	chainKey              []byte             // HMAC key of the hash chain, nil for plain SHA-256
+	lastHash              []byte             // Hash of the last record written, the next record links to it
+	nextHash              []byte             // Hash of the record being written
+	scrubInterval         time.Duration      // Pause between two scrub passes, 0 when scrubbing is off
+	scrubRate             int64              // Bytes per second the scrubber reads, 0 for no limit
+	scrubDone             chan struct{}      // Closed when the scrubber goroutine exits
+	scrubLock             sync.Mutex         // Guards scrubStats
+	scrubStats            ScrubStats
+	framing               Framing                  // How new segments frame their records
+	blockFraming          bool                     // The current segment is framed in blocks
+	fragmentHeader        [fragmentHeaderSize]byte // Reused to encode fragment headers
+	blobThreshold         int                      // Records with more stored data go to blob files, 0 to keep all data in the segments
+	blobFile              File                     // Blob file being appended to, nil until the first blob is written
+	blobBaseLSN           uint64                   // Base LSN of blobFile
+	blobSize              int64                    // Size of blobFile
+	blobsUnsynced         bool                     // blobFile has blobs the last sync did not cover
+	scratchBlob           pb.BlobPointer           // Reused to point records to their blob
 }
@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SegmentNaming selects how segment files are named.
+type SegmentNaming int
+
+const (
+	SegmentNamingCounter SegmentNaming = iota // wal-segment-<n>.log, with n counting segments from 1
+	SegmentNamingBaseLSN                      // <base LSN>.log zero padded to 20 digits, so names sort lexically in LSN order
+)
+
+const baseLSNDigits = 20 // Digits of the largest uint64
+
+// fileName returns the name of the segment with the given number, which is
+// the base LSN for SegmentNamingBaseLSN.
+func (naming SegmentNaming) fileName(segmentNumber uint64) string {
+	if naming == SegmentNamingBaseLSN {
+		return fmt.Sprintf("%0*d.log", baseLSNDigits, segmentNumber)
+	}
+	return fmt.Sprintf("%s%d.log", SegmentPrefix, segmentNumber)
+}
+
+// pattern returns the glob matching segment files, and no other files.
+func (naming SegmentNaming) pattern() string {
+	if naming == SegmentNamingBaseLSN {
+		return strings.Repeat("[0-9]", baseLSNDigits) + ".log"
+	}
+	return SegmentPrefix + "*.log"
+}
+
+// parse returns the segment number of a segment file.
+func (naming SegmentNaming) parse(segmentPath string) (uint64, error) {
+	name := strings.TrimSuffix(filepath.Base(segmentPath), ".log")
+	if naming == SegmentNamingCounter {
+		name = strings.TrimPrefix(name, SegmentPrefix)
+	}
+	segmentNumber, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse segment number from file %s: %w", segmentPath, err)
+	}
+	return segmentNumber, nil
+}
+
+// DetectSegmentNaming returns how the segments in dir are named. A directory
+// holding no base LSN named segments uses SegmentNamingCounter, as it would be
+// migrated by StartLogger otherwise.
+func DetectSegmentNaming(fs FS, dir string) (SegmentNaming, error) {
+	segmentFiles, err := listSegmentFiles(fs, dir, SegmentNamingBaseLSN)
+	if err != nil {
+		return SegmentNamingCounter, err
+	}
+	if len(segmentFiles) > 0 {
+		return SegmentNamingBaseLSN, nil
+	}
+	return SegmentNamingCounter, nil
+}
+
+// MigrateSegmentNames renames the wal-segment-<n>.log segments in dir after
+// their base LSN, as used by SegmentNamingBaseLSN. Segments without records
+// are removed, since their base LSN would collide with the next segment's.
+// It can be run again after a crash and is run by StartLogger when the
+// configuration asks for base LSN names.
+func MigrateSegmentNames(fs FS, dir string) error {
+	segmentFiles, err := listSegmentFiles(fs, dir, SegmentNamingCounter)
+	if err != nil || len(segmentFiles) == 0 {
+		return err
+	}
+
+	// Segments holding parts of the same record start with the same LSN, so
+	// names have to grow past the segments migrated already
+	migratedFiles, err := listSegmentFiles(fs, dir, SegmentNamingBaseLSN)
+	if err != nil {
+		return err
+	}
+	lastBaseLSN, err := getLastSegmentFileNumber(migratedFiles, SegmentNamingBaseLSN)
+	if err != nil {
+		return err
+	}
+
+	for _, segmentFile := range segmentFiles {
+		// A torn tail is repaired by StartLogger later, the records before it
+		// decide the name
+		records, _, err := scanSegment(fs, segmentFile, -1)
+		if err != nil && !errors.Is(err, ErrCorruptRecord) {
+			return err
+		}
+
+		// The index is rebuilt under the new name
+		if err := fs.Remove(indexFilePath(segmentFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if len(records) == 0 {
+			if err := fs.Remove(segmentFile); err != nil {
+				return err
+			}
+			continue
+		}
+
+		baseLSN := max(records[0].GetLogSequenceNumber(), lastBaseLSN+1)
+		lastBaseLSN = baseLSN
+		migratedPath := filepath.Join(dir, SegmentNamingBaseLSN.fileName(baseLSN))
+		if _, err := fs.Stat(migratedPath); err == nil {
+			return fmt.Errorf("refusing to overwrite existing segment %s: %w", migratedPath, os.ErrExist)
+		}
+		if err := fs.Rename(segmentFile, migratedPath); err != nil {
+			return err
+		}
+		fmt.Printf("Renamed WAL segment %s to %s\n", segmentFile, migratedPath)
+	}
+
+	if err := fs.SyncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package wal
+
+import (
+	"fmt"
+	pb "walstore/proto"
+
+	gpb "google.golang.org/protobuf/proto"
+)
+
+// minSegmentSize is the smallest MaxFileSize that leaves room for a part of a
+// record next to the footer, whatever the framing and record fields.
+const minSegmentSize = 256
+
+// fitsEmptySegment reports whether a record of size bytes fits into a new
+// segment, or has to be split into parts.
+func (wal *WriteAheadLog) fitsEmptySegment(size int) bool {
+	return framedSizeAt(0, wal.framing == FramingBlocks, size)+footerReserve < wal.maxFileSize
+}
+
+// appendParts writes the record in wal.scratchRecord, whose data is too large
+// for any segment, as parts with the same LSN that each fill up the current
+// segment. Only the last part leaves room for more records, so segments never
+// grow past maxFileSize. Readers join the parts again, see recordParts.
+func (wal *WriteAheadLog) appendParts(storedData []byte) error {
+	for part := uint32(0); len(storedData) > 0; part++ {
+		size, err := wal.writePart(storedData, part, true)
+		if err != nil {
+			wal.abandonRecord(part)
+			return err
+		}
+		storedData = storedData[size:]
+	}
+	return nil
+}
+
+// writePart writes as much of data as fits into the current segment as a part
+// of the record in wal.scratchRecord, rotating first when the segment has no
+// room left, and returns how much it wrote. The record ends with data when
+// last is set.
+func (wal *WriteAheadLog) writePart(data []byte, part uint32, last bool) (int, error) {
+	record := &wal.scratchRecord
+	defer func() { record.Data, record.Part, record.Continued = nil, 0, false }()
+
+	size := min(len(data), int(wal.maxFileSize-wal.currSegmentSize))
+	var encodedPart []byte
+	for {
+		if size < 0 || (size == 0 && len(data) > 0) {
+			if wal.currSegmentSize == 0 {
+				return 0, fmt.Errorf("segment size %d leaves no room for a record part", wal.maxFileSize)
+			}
+			if err := wal.rotateLog(); err != nil {
+				return 0, err
+			}
+			size = min(len(data), int(wal.maxFileSize))
+			continue
+		}
+
+		record.Data = data[:size]
+		record.Checksum = recordChecksum(record.Data, record.LogSequenceNumber)
+		record.Part = part
+		record.Continued = size < len(data) || !last
+		var err error
+		encodedPart, err = gpb.MarshalOptions{}.MarshalAppend(append(wal.scratchBuffer[:0], 0, 0, 0, 0), record)
+		if err != nil {
+			return 0, err
+		}
+		wal.keepScratchBuffer(encodedPart)
+
+		// Shrink the part until it fits behind the records already in the segment
+		excess := wal.currSegmentSize + wal.framedSize(len(encodedPart)-4) + footerReserve - (wal.maxFileSize - 1)
+		if excess <= 0 {
+			break
+		}
+		size -= max(int(excess), 1)
+	}
+
+	if err := wal.reserveInFlight(int64(len(encodedPart))); err != nil {
+		return 0, err
+	}
+	partOffset, err := wal.writeToBuffer(encodedPart)
+	if err != nil {
+		return 0, err
+	}
+	wal.currentIndex().add(record.LogSequenceNumber, partOffset, record.Timestamp, size, wal.indexInterval)
+	return size, nil
+}
+
+// abandonRecord gives up on the record in wal.scratchRecord after a failure.
+// Once parts of it were written its LSN is used up: readers skip parts of
+// records that never got their last part.
+func (wal *WriteAheadLog) abandonRecord(partsWritten uint32) {
+	if partsWritten > 0 {
+		wal.lastLogSequenceNumber = wal.scratchRecord.LogSequenceNumber
+	}
+}
+
+// recordParts joins the parts of records split across segments while reading
+// them in either direction. Parts of a record whose other parts were not read
+// are dropped: its first parts were deleted by retention, or a crash or a
+// failed write cut it off before its last part.
+type recordParts struct {
+	parts []*pb.WalRecord // Parts of the record being joined, in the order they were read
+}
+
+// add takes the next record read forward and returns it once it is complete,
+// nil while parts are missing.
+func (parts *recordParts) add(record *pb.WalRecord) *pb.WalRecord {
+	if record.GetPart() == 0 {
+		parts.parts = parts.parts[:0]
+	} else if len(parts.parts) == 0 || !continues(parts.parts[len(parts.parts)-1], record) {
+		parts.parts = parts.parts[:0]
+		return nil
+	}
+	if record.GetContinued() {
+		parts.parts = append(parts.parts, record)
+		return nil
+	}
+	if len(parts.parts) == 0 {
+		return record
+	}
+	return parts.join(append(parts.parts, record))
+}
+
+// addReverse takes the previous record read backwards and returns it once it
+// is complete, nil while parts are missing.
+func (parts *recordParts) addReverse(record *pb.WalRecord) *pb.WalRecord {
+	if !record.GetContinued() {
+		parts.parts = parts.parts[:0]
+	} else if len(parts.parts) == 0 || !continues(record, parts.parts[len(parts.parts)-1]) {
+		parts.parts = parts.parts[:0]
+		return nil
+	}
+	if record.GetPart() > 0 {
+		parts.parts = append(parts.parts, record)
+		return nil
+	}
+	if len(parts.parts) == 0 {
+		return record
+	}
+	joined := append(parts.parts, record)
+	for i, j := 0, len(joined)-1; i < j; i, j = i+1, j-1 {
+		joined[i], joined[j] = joined[j], joined[i]
+	}
+	return parts.join(joined)
+}
+
+// join returns the record made of all its parts, in order.
+func (parts *recordParts) join(all []*pb.WalRecord) *pb.WalRecord {
+	var size int
+	for _, part := range all {
+		size += len(part.GetData())
+	}
+	data := make([]byte, 0, size)
+	for _, part := range all {
+		data = append(data, part.GetData()...)
+	}
+
+	record := all[0]
+	record.Data = data
+	record.Checksum = recordChecksum(data, record.GetLogSequenceNumber())
+	record.Continued = false
+	clear(parts.parts)
+	parts.parts = parts.parts[:0]
+	return record
+}
+
+// continues reports whether next is the part that follows part.
+func continues(part *pb.WalRecord, next *pb.WalRecord) bool {
+	return part.GetContinued() && next.GetLogSequenceNumber() == part.GetLogSequenceNumber() && next.GetPart() == part.GetPart()+1
+}
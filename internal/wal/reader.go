@@ -0,0 +1,373 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	pb "walstore/proto"
+
+	gpb "google.golang.org/protobuf/proto"
+)
+
+// ErrLSNNotFound is returned when a log sequence number is not in the WAL,
+// because it was not written yet or its segment was deleted by retention.
+var ErrLSNNotFound = errors.New("log sequence number not found")
+
+// segmentReader reads and verifies the records of a segment one by one,
+// starting at any record boundary.
+type segmentReader struct {
+	file      File
+	reader    *bufio.Reader
+	path      string
+	fileSize  int64
+	offset    int64  // Offset of the next record
+	limit     int64  // Offset to stop at, negative to read up to the end of the records
+	lastLSN   uint64 // LSN of the previous record, 0 before the first one
+	checksum  uint32 // CRC-32 of the bytes read so far
+	blocks    bool   // The segment is framed in blocks, see FramingBlocks
+	position  int64  // Offset of the next byte to read, ahead of offset within a record's fragments
+	brokenAt  int64  // Offset where the framing of the last record broke, -1 when it was intact
+	resyncing bool   // Skip fragments of records that started before the resync point
+	header    [fragmentHeaderSize]byte
+}
+
+func openSegmentReader(fs FS, segmentPath string, offset int64, limit int64) (*segmentReader, error) {
+	file, err := fs.OpenFile(segmentPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	framing, err := detectFraming(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := &segmentReader{
+		file:     file,
+		reader:   bufio.NewReaderSize(file, 64*1024),
+		path:     segmentPath,
+		fileSize: fileInfo.Size(),
+		limit:    limit,
+		blocks:   framing == FramingBlocks,
+	}
+	if reader.blocks && offset == 0 {
+		// Records start behind the magic
+		offset = int64(len(blockMagic))
+	}
+	if err := reader.reset(offset, limit); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if offset == int64(len(blockMagic)) && reader.blocks {
+		// The segment checksum covers the magic as well
+		reader.checksum = crc32.ChecksumIEEE(blockMagic)
+	}
+	return reader, nil
+}
+
+// next returns the next record and its offset, or io.EOF at the end of the
+// file, at a segment terminator or at the limit.
+func (reader *segmentReader) next() (*pb.WalRecord, int64, error) {
+	offset := reader.offset
+	reader.brokenAt = -1
+	if reader.limit >= 0 && offset >= reader.limit {
+		return nil, offset, io.EOF
+	}
+
+	var data []byte
+	var err error
+	if reader.blocks {
+		data, err = reader.readFragments()
+	} else {
+		data, err = reader.readLengthPrefixed()
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+
+	var record pb.WalRecord
+	if err := gpb.Unmarshal(data, &record); err != nil {
+		return nil, offset, fmt.Errorf("%w: %v at offset %d in %s", ErrCorruptRecord, err, offset, reader.path)
+	}
+	if record.GetChecksum() != recordChecksum(record.GetData(), record.GetLogSequenceNumber()) {
+		return nil, offset, fmt.Errorf("%w: checksum mismatch for lsn %d in %s", ErrCorruptRecord, record.GetLogSequenceNumber(), reader.path)
+	}
+	// Parts of a record share its LSN
+	if reader.lastLSN != 0 && record.GetLogSequenceNumber() != reader.lastLSN+1 && (record.GetLogSequenceNumber() != reader.lastLSN || record.GetPart() == 0) {
+		// A stale record left behind in a recycled segment
+		return nil, offset, fmt.Errorf("%w: unexpected lsn %d at offset %d in %s", ErrCorruptRecord, record.GetLogSequenceNumber(), offset, reader.path)
+	}
+
+	reader.lastLSN = record.GetLogSequenceNumber()
+	reader.offset = reader.position
+	return &record, offset, nil
+}
+
+// readLengthPrefixed reads the data of the next record framed by its size.
+func (reader *segmentReader) readLengthPrefixed() ([]byte, error) {
+	offset := reader.offset
+	header := reader.header[:4]
+	// Read the size of the next record
+	if _, err := io.ReadFull(reader.reader, header); err != nil {
+		reader.brokenAt = offset
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: torn record size at offset %d in %s", ErrCorruptRecord, offset, reader.path)
+		}
+		return nil, err
+	}
+	recordSize := int32(binary.LittleEndian.Uint32(header))
+	if recordSize == 0 {
+		// Segment terminator or preallocated space, no more records
+		reader.brokenAt = offset
+		return nil, io.EOF
+	}
+	if recordSize < 0 || offset+4+int64(recordSize) > reader.fileSize {
+		reader.brokenAt = offset
+		return nil, fmt.Errorf("%w: invalid record size %d at offset %d in %s", ErrCorruptRecord, recordSize, offset, reader.path)
+	}
+
+	data := make([]byte, recordSize)
+	// Read the record data
+	if _, err := io.ReadFull(reader.reader, data); err != nil {
+		reader.brokenAt = offset
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: torn record at offset %d in %s", ErrCorruptRecord, offset, reader.path)
+		}
+		return nil, err
+	}
+
+	reader.position = offset + 4 + int64(recordSize)
+	reader.checksum = crc32.Update(crc32.Update(reader.checksum, crc32.IEEETable, header), crc32.IEEETable, data)
+	return data, nil
+}
+
+// reset moves the reader to another record boundary of the same segment.
+func (reader *segmentReader) reset(offset int64, limit int64) error {
+	if _, err := reader.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek: %w", err)
+	}
+	reader.reader.Reset(reader.file)
+	reader.offset = offset
+	reader.position = offset
+	reader.limit = limit
+	reader.lastLSN = 0
+	reader.resyncing = false
+	reader.checksum = 0
+	return nil
+}
+
+func (reader *segmentReader) close() error {
+	return reader.file.Close()
+}
+
+// RecordIterator walks the records of the WAL in LSN order. It sees the
+// records written before it was created; segments deleted by retention while
+// iterating make Next fail with ErrLSNNotFound.
+type RecordIterator struct {
+	fs         FS
+	directory  string          // Holds the blob files records may point to
+	ciphers    *cipherCache    // Decrypts records, nil when encryption is off
+	raw        bool            // Return records as stored
+	segments   []segmentCursor // Segments still to read, the first one is being read
+	reader     *segmentReader
+	parts      recordParts // Joins records split across segments
+	from       uint64
+	lastLSN    uint64 // LSN of the record returned last
+	readLSN    uint64 // LSN of the record or part read last
+	startedLSN uint64 // LSN of the last record whose first part was read
+}
+
+// segmentCursor is the part of a segment an iterator reads.
+type segmentCursor struct {
+	path    string
+	offset  int64
+	limit   int64
+	lastLSN uint64
+}
+
+// flushForReaders writes the records still in the buffer to the current
+// segment, so readers opening it see them. Must be called with wal.lock held.
+func (wal *WriteAheadLog) flushForReaders() error {
+	if wal.bufferWriter.Buffered() == 0 {
+		return nil
+	}
+	if err := wal.bufferWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush buffer: %w", err)
+	}
+	return nil
+}
+
+// Iterate returns an iterator over the records starting at from, or at the
+// oldest record still in the WAL when from was deleted already. The sparse
+// index lets it start reading close to from instead of at the start of the
+// segment.
+func (wal *WriteAheadLog) Iterate(from uint64) (*RecordIterator, error) {
+	return wal.iterate(from, false)
+}
+
+// iterate returns an iterator like Iterate, which returns records as stored,
+// still encrypted and compressed, when raw is set.
+func (wal *WriteAheadLog) iterate(from uint64, raw bool) (*RecordIterator, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if err := wal.flushForReaders(); err != nil {
+		return nil, err
+	}
+
+	iterator := &RecordIterator{fs: wal.fs, directory: wal.directory, ciphers: wal.ciphers, raw: raw, from: from}
+	first := sort.Search(len(wal.segments), func(i int) bool { return wal.segments[i].lastLSN >= from })
+	for _, index := range wal.segments[first:] {
+		if index.empty() {
+			continue
+		}
+		cursor := segmentCursor{path: index.path, limit: index.size, lastLSN: index.lastLSN}
+		if index == wal.currentIndex() {
+			cursor.limit = wal.currSegmentSize
+		}
+		if len(iterator.segments) == 0 && index.contains(from) {
+			cursor.offset = index.seek(from)
+		}
+		iterator.segments = append(iterator.segments, cursor)
+	}
+
+	return iterator, nil
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (iterator *RecordIterator) Next() (*pb.WalRecord, error) {
+	for {
+		record, err := iterator.nextPart()
+		if err != nil {
+			return nil, err
+		}
+
+		lsn := record.GetLogSequenceNumber()
+		if record.GetPart() == 0 {
+			// Records that never got their last part keep their LSN
+			if iterator.startedLSN != 0 && lsn != iterator.startedLSN+1 {
+				return nil, fmt.Errorf("%w: records after %d were deleted", ErrLSNNotFound, iterator.lastLSN)
+			}
+			iterator.startedLSN = lsn
+		}
+		if record = iterator.parts.add(record); record == nil {
+			continue
+		}
+		iterator.lastLSN = lsn
+		if err := readBlob(iterator.fs, iterator.directory, record); err != nil {
+			return nil, err
+		}
+		if iterator.raw {
+			return record, nil
+		}
+		if err := decodeRecord(record, iterator.ciphers); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+}
+
+// nextPart returns the next record or part of a record from from on, as
+// stored, or io.EOF after the last one.
+func (iterator *RecordIterator) nextPart() (*pb.WalRecord, error) {
+	for len(iterator.segments) > 0 {
+		cursor := iterator.segments[0]
+		if iterator.reader == nil {
+			reader, err := openSegmentReader(iterator.fs, cursor.path, cursor.offset, cursor.limit)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w: segment %s was deleted", ErrLSNNotFound, cursor.path)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to open WAL segment file: %w", err)
+			}
+			iterator.reader = reader
+		}
+
+		record, _, err := iterator.reader.next()
+		if err == io.EOF {
+			iterator.reader.close()
+			iterator.reader = nil
+			iterator.segments = iterator.segments[1:]
+			if iterator.readLSN < cursor.lastLSN && iterator.readLSN >= iterator.from {
+				// The segment was recycled while we were reading it
+				return nil, fmt.Errorf("%w: records after %d were deleted", ErrLSNNotFound, iterator.lastLSN)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		iterator.readLSN = record.GetLogSequenceNumber()
+		if iterator.readLSN < iterator.from {
+			continue
+		}
+		return record, nil
+	}
+
+	return nil, io.EOF
+}
+
+// Close releases the segment file the iterator has open.
+func (iterator *RecordIterator) Close() error {
+	iterator.segments = nil
+	if iterator.reader == nil {
+		return nil
+	}
+	err := iterator.reader.close()
+	iterator.reader = nil
+	return err
+}
+
+// ReadAt returns the record with the given log sequence number. It reads at
+// most Config.IndexInterval records to find it.
+func (wal *WriteAheadLog) ReadAt(lsn uint64) (*pb.WalRecord, error) {
+	iterator, err := wal.Iterate(lsn)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	record, err := iterator.Next()
+	if err == io.EOF || (err == nil && record.GetLogSequenceNumber() != lsn) {
+		return nil, fmt.Errorf("%w: %d", ErrLSNNotFound, lsn)
+	}
+	return record, err
+}
+
+// ReadRange returns the records from from to to, both included, that are
+// still in the WAL.
+func (wal *WriteAheadLog) ReadRange(from uint64, to uint64) ([]*pb.WalRecord, error) {
+	iterator, err := wal.Iterate(from)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var walRecords []*pb.WalRecord
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF || (err == nil && record.GetLogSequenceNumber() > to) {
+			return walRecords, nil
+		}
+		if err != nil {
+			return walRecords, err
+		}
+		walRecords = append(walRecords, record)
+	}
+}
@@ -0,0 +1,200 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	pb "walstore/proto"
+)
+
+// ReverseIterator walks the records of the WAL from newest to oldest. Records
+// are only framed by a length prefix, so it reads the block between two
+// sparse index entries forward and returns it backwards, holding at most
+// Config.IndexInterval records in memory.
+type ReverseIterator struct {
+	fs        FS
+	directory string          // Holds the blob files records may point to
+	ciphers   *cipherCache    // Decrypts records, nil when encryption is off
+	segments  []reverseCursor // Segments still to read, the last one is being read
+	reader    *segmentReader
+	block     []*pb.WalRecord // Records of the current block not returned yet
+	raw       bool            // Return records as stored
+	parts     recordParts     // Joins records split across segments
+	from      uint64
+	lastLSN   uint64 // LSN of the record returned last
+	readLSN   uint64 // LSN of the record or part read last
+}
+
+// reverseCursor is the part of a segment a reverse iterator reads, split into
+// blocks at its index entries.
+type reverseCursor struct {
+	path    string
+	limit   int64
+	entries []indexEntry // Blocks still to read, the last one is read next
+}
+
+// IterateReverse returns an iterator over the records from from down to the
+// oldest record still in the WAL. A from past the last record, such as
+// math.MaxUint64, starts at the newest record.
+func (wal *WriteAheadLog) IterateReverse(from uint64) (*ReverseIterator, error) {
+	return wal.iterateReverse(from, false)
+}
+
+// iterateReverse returns an iterator like IterateReverse, which returns
+// records as stored when raw is set.
+func (wal *WriteAheadLog) iterateReverse(from uint64, raw bool) (*ReverseIterator, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if err := wal.flushForReaders(); err != nil {
+		return nil, err
+	}
+
+	iterator := &ReverseIterator{fs: wal.fs, directory: wal.directory, ciphers: wal.ciphers, raw: raw, from: from}
+	for _, index := range wal.segments {
+		if index.empty() || index.firstLSN > from {
+			continue
+		}
+		cursor := reverseCursor{path: index.path, limit: index.size, entries: slices.Clip(index.entries)}
+		if index == wal.currentIndex() {
+			cursor.limit = wal.currSegmentSize
+		}
+		iterator.segments = append(iterator.segments, cursor)
+	}
+
+	return iterator, nil
+}
+
+// Next returns the previous record, or io.EOF after the oldest one.
+func (iterator *ReverseIterator) Next() (*pb.WalRecord, error) {
+	for {
+		for len(iterator.block) > 0 {
+			record := iterator.block[len(iterator.block)-1]
+			iterator.block[len(iterator.block)-1] = nil
+			iterator.block = iterator.block[:len(iterator.block)-1]
+
+			lsn := record.GetLogSequenceNumber()
+			if lsn > iterator.from {
+				continue
+			}
+			// Records that never got their last part keep their LSN, so the
+			// parts read last count as well
+			if !record.GetContinued() && iterator.readLSN != 0 && lsn != iterator.readLSN-1 {
+				return nil, fmt.Errorf("%w: records before %d were deleted", ErrLSNNotFound, iterator.lastLSN)
+			}
+			iterator.readLSN = lsn
+			if record = iterator.parts.addReverse(record); record == nil {
+				continue
+			}
+			iterator.lastLSN = lsn
+			if err := readBlob(iterator.fs, iterator.directory, record); err != nil {
+				return nil, err
+			}
+			if iterator.raw {
+				return record, nil
+			}
+			if err := decodeRecord(record, iterator.ciphers); err != nil {
+				return nil, err
+			}
+			return record, nil
+		}
+
+		if len(iterator.segments) == 0 {
+			return nil, io.EOF
+		}
+		if err := iterator.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readBlock reads the last unread block of the current segment, moving on to
+// the previous segment once all blocks were read.
+func (iterator *ReverseIterator) readBlock() error {
+	cursor := &iterator.segments[len(iterator.segments)-1]
+	if len(cursor.entries) == 0 {
+		iterator.closeReader()
+		iterator.segments = iterator.segments[:len(iterator.segments)-1]
+		return nil
+	}
+
+	entry := cursor.entries[len(cursor.entries)-1]
+	cursor.entries = cursor.entries[:len(cursor.entries)-1]
+	limit := cursor.limit
+	cursor.limit = entry.offset
+	if entry.lsn > iterator.from {
+		return nil
+	}
+
+	if iterator.reader == nil {
+		reader, err := openSegmentReader(iterator.fs, cursor.path, entry.offset, limit)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: segment %s was deleted", ErrLSNNotFound, cursor.path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open WAL segment file: %w", err)
+		}
+		iterator.reader = reader
+	} else if err := iterator.reader.reset(entry.offset, limit); err != nil {
+		return err
+	}
+
+	for {
+		record, _, err := iterator.reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		iterator.block = append(iterator.block, record)
+	}
+	if len(iterator.block) == 0 || iterator.block[0].GetLogSequenceNumber() != entry.lsn {
+		// The segment was recycled while we were reading it
+		return fmt.Errorf("%w: records from %d were deleted", ErrLSNNotFound, entry.lsn)
+	}
+	return nil
+}
+
+func (iterator *ReverseIterator) closeReader() {
+	if iterator.reader != nil {
+		iterator.reader.close()
+		iterator.reader = nil
+	}
+}
+
+// Close releases the segment file the iterator has open.
+func (iterator *ReverseIterator) Close() error {
+	iterator.segments = nil
+	iterator.block = nil
+	if iterator.reader == nil {
+		return nil
+	}
+	err := iterator.reader.close()
+	iterator.reader = nil
+	return err
+}
+
+// LastRecords returns up to n of the newest records, newest first.
+func (wal *WriteAheadLog) LastRecords(n int) ([]*pb.WalRecord, error) {
+	iterator, err := wal.IterateReverse(^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var walRecords []*pb.WalRecord
+	for len(walRecords) < n {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return walRecords, err
+		}
+		walRecords = append(walRecords, record)
+	}
+	return walRecords, nil
+}
@@ -0,0 +1,222 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// ScrubStats counts the work of the scrubber since the WAL was started.
+type ScrubStats struct {
+	Passes           uint64    // Completed passes over the sealed segments
+	SegmentsScrubbed uint64    // Segments verified, including corrupt ones
+	BytesScrubbed    uint64    // Bytes of records read
+	CorruptSegments  uint64    // Segments that failed verification
+	LastPass         time.Time // When the last pass completed
+}
+
+// ScrubStats returns the scrubber's counters.
+func (wal *WriteAheadLog) ScrubStats() ScrubStats {
+	wal.scrubLock.Lock()
+	defer wal.scrubLock.Unlock()
+
+	return wal.scrubStats
+}
+
+// scrubPeriodically runs a scrub pass every time the timer fires until the WAL
+// is closed.
+func (wal *WriteAheadLog) scrubPeriodically(timer Timer) {
+	defer close(wal.scrubDone)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			if err := wal.Scrub(wal.context); err != nil && !errors.Is(err, context.Canceled) {
+				fmt.Printf("Error scrubbing WAL: %v\n", err)
+			}
+			timer.Reset(wal.scrubInterval)
+
+		case <-wal.context.Done():
+			return
+		}
+	}
+}
+
+// Scrub re-reads every sealed segment, verifying the checksum of each record,
+// of the blobs its records point to and of the whole segment against its
+// footer, at no more than Config.ScrubRate bytes per second. Corrupt segments
+// are logged, reported to CorruptionHooks.OnCorruption and returned, joined
+// into one error. Blobs of records in the current segment are not scrubbed.
+func (wal *WriteAheadLog) Scrub(ctx context.Context) error {
+	_, err := wal.scrub(ctx)
+	return err
+}
+
+// scrub is Scrub, also returning the corrupt segments.
+func (wal *WriteAheadLog) scrub(ctx context.Context) ([]SegmentInfo, error) {
+	// Snapshot the sealed segments, they do not change anymore
+	wal.lock.Lock()
+	sealed := make([]segmentIndex, 0, len(wal.segments))
+	for _, index := range wal.segments[:len(wal.segments)-1] {
+		sealed = append(sealed, segmentIndex{path: index.path, firstLSN: index.firstLSN, lastLSN: index.lastLSN, size: index.size, entries: index.entries, sealed: index.sealed})
+	}
+	wal.lock.Unlock()
+
+	throttle := newScrubThrottle(wal.clock, wal.scrubRate)
+	var corruptSegments []SegmentInfo
+	var corruptions []error
+	for i := range sealed {
+		index := &sealed[i]
+		err := wal.scrubSegment(ctx, index, throttle)
+		if errors.Is(err, os.ErrNotExist) || (err != nil && !wal.hasSegment(index.path)) {
+			// Deleted or recycled by retention in the meantime
+			continue
+		}
+		if ctx.Err() != nil {
+			return corruptSegments, ctx.Err()
+		}
+
+		wal.scrubLock.Lock()
+		wal.scrubStats.SegmentsScrubbed++
+		if err != nil {
+			wal.scrubStats.CorruptSegments++
+		}
+		wal.scrubLock.Unlock()
+
+		if err != nil {
+			fmt.Printf("Scrubbing WAL segment %s found corruption: %v\n", index.path, err)
+			segment := SegmentInfo{Path: index.path, FirstLSN: index.firstLSN, LastLSN: index.lastLSN, Size: index.size}
+			wal.hooks.push(func(hooks Hooks) {
+				if corruptionHooks, ok := hooks.(CorruptionHooks); ok {
+					corruptionHooks.OnCorruption(segment, err)
+				}
+			})
+			corruptSegments = append(corruptSegments, segment)
+			corruptions = append(corruptions, err)
+		}
+	}
+
+	wal.scrubLock.Lock()
+	wal.scrubStats.Passes++
+	wal.scrubStats.LastPass = wal.clock.Now()
+	wal.scrubLock.Unlock()
+
+	return corruptSegments, errors.Join(corruptions...)
+}
+
+func (wal *WriteAheadLog) hasSegment(segmentPath string) bool {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return slices.ContainsFunc(wal.segments, func(index *segmentIndex) bool { return index.path == segmentPath })
+}
+
+// scrubSegment reads the records of a sealed segment and their blobs, and
+// checks them against its index and footer.
+func (wal *WriteAheadLog) scrubSegment(ctx context.Context, index *segmentIndex, throttle *scrubThrottle) error {
+	reader, err := openSegmentReader(wal.fs, index.path, 0, index.size)
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+
+	var firstLSN uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		offset := reader.offset
+		record, _, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+
+		wal.scrubLock.Lock()
+		wal.scrubStats.BytesScrubbed += uint64(reader.offset - offset)
+		wal.scrubLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if firstLSN == 0 {
+			firstLSN = record.GetLogSequenceNumber()
+		}
+		if err := throttle.wait(ctx, reader.offset-offset); err != nil {
+			return err
+		}
+
+		// Blobs are read back against the checksum in their pointer
+		if blob := record.GetBlob(); blob != nil {
+			if err := readBlob(wal.fs, wal.directory, record); err != nil {
+				return err
+			}
+			wal.scrubLock.Lock()
+			wal.scrubStats.BytesScrubbed += uint64(blob.GetLength())
+			wal.scrubLock.Unlock()
+			if err := throttle.wait(ctx, blob.GetLength()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if reader.offset != index.size || (!index.empty() && (firstLSN != index.firstLSN || reader.lastLSN != index.lastLSN)) {
+		return fmt.Errorf("%w: segment %s holds lsn %d to %d in %d bytes, expected %d to %d in %d bytes",
+			ErrCorruptRecord, index.path, firstLSN, reader.lastLSN, reader.offset, index.firstLSN, index.lastLSN, index.size)
+	}
+
+	footer, err := readSegmentFooter(wal.fs, index.path, index.size)
+	if errors.Is(err, ErrNoFooter) {
+		if index.sealed {
+			return fmt.Errorf("%w: segment %s lost its footer", ErrCorruptRecord, index.path)
+		}
+		// Sealed before footers existed, the record checksums have to do
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if footer.Checksum != reader.checksum {
+		return fmt.Errorf("%w: checksum mismatch for segment %s", ErrCorruptRecord, index.path)
+	}
+	return nil
+}
+
+// scrubThrottle limits the read rate of a scrub pass.
+type scrubThrottle struct {
+	clock   Clock
+	rate    int64 // Bytes per second, 0 for no limit
+	started time.Time
+	read    int64
+}
+
+func newScrubThrottle(clock Clock, rate int64) *scrubThrottle {
+	return &scrubThrottle{clock: clock, rate: rate, started: clock.Now()}
+}
+
+// wait accounts for size bytes read and blocks until reading them fits the
+// rate.
+func (throttle *scrubThrottle) wait(ctx context.Context, size int64) error {
+	if throttle.rate == 0 {
+		return nil
+	}
+
+	throttle.read += size
+	due := throttle.started.Add(time.Duration(float64(throttle.read) / float64(throttle.rate) * float64(time.Second)))
+	delay := due.Sub(throttle.clock.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := throttle.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,105 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// segmentTerminator marks the logical end of the data in a segment whose file
+// is longer than its records, e.g. because it was preallocated or recycled. A
+// zero record size can never be written for a real record.
+var segmentTerminator = make([]byte, 4)
+
+// allocator is implemented by files that can reserve space up front.
+type allocator interface {
+	Allocate(size int64) error
+}
+
+// allocateFile grows a file to size bytes of zeros, using fallocate where the
+// platform supports it. Files that are already large enough are left alone.
+func allocateFile(file File, size int64) error {
+	switch file := file.(type) {
+	case allocator:
+		return file.Allocate(size)
+	case *os.File:
+		return fallocate(file, size)
+	default:
+		return extendFile(file, size)
+	}
+}
+
+func extendFile(file File, size int64) error {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() >= size {
+		return nil
+	}
+	return file.Truncate(size)
+}
+
+// terminateSegment writes a terminator at offset so that readers stop there
+// instead of running into stale or torn bytes behind it.
+func terminateSegment(file File, offset int64) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := file.Write(segmentTerminator); err != nil {
+		return fmt.Errorf("failed to write segment terminator: %w", err)
+	}
+	return nil
+}
+
+// recycleSegmentFile turns an old segment into the next one by renaming it,
+// which keeps its blocks allocated. The old records stay in the file but are
+// unreachable: the terminator at offset 0 is made durable before the rename.
+func (wal *WriteAheadLog) recycleSegmentFile(oldSegmentPath string, newSegmentPath string) (File, error) {
+	// Only pay for reading the segment when somebody is listening
+	var recycledSegment SegmentInfo
+	if wal.hooks != nil {
+		var err error
+		if recycledSegment, err = wal.segmentInfo(oldSegmentPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := wal.fs.Stat(newSegmentPath); err == nil {
+		return nil, fmt.Errorf("refusing to overwrite existing segment %s: %w", newSegmentPath, os.ErrExist)
+	}
+
+	file, err := wal.fs.OpenFile(oldSegmentPath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := terminateSegment(file, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if wal.preallocate {
+		if err := allocateFile(file, wal.maxFileSize); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to preallocate segment: %w", err)
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := wal.fs.Rename(oldSegmentPath, newSegmentPath); err != nil {
+		return nil, err
+	}
+	wal.dropSegmentIndex(oldSegmentPath)
+	if err := wal.fs.SyncDir(wal.directory); err != nil {
+		return nil, fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+
+	wal.hooks.push(func(hooks Hooks) { hooks.OnSegmentDeleted(recycledSegment) })
+
+	return wal.fs.OpenFile(newSegmentPath, os.O_RDWR|wal.syncMode.openFlags(), 0644)
+}
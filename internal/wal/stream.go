@@ -0,0 +1,257 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	pb "walstore/proto"
+
+	gpb "google.golang.org/protobuf/proto"
+)
+
+// streamPartSize is the most data of a record written by WriteRecordFrom that
+// is held in memory, and so the largest part readers of it have to load.
+const streamPartSize = 256 * 1024
+
+// ErrStreamingUnsupported is returned by WriteRecordFrom when a Codec or a
+// KeyProvider is configured. Compression and encryption work on the whole
+// record, which WriteRecordFrom never holds in memory.
+var ErrStreamingUnsupported = errors.New("records cannot be written from a reader with a codec or key provider configured")
+
+// WriteRecordFrom writes the next size bytes of r as a record without reading
+// them into memory at once: they are written as parts of at most 256 KiB,
+// which readers join again, see OpenRecord, or to a blob file when size is
+// above Config.BlobThreshold. The data is stored raw, so it fails with
+// ErrStreamingUnsupported, before reading from r, when a Codec or a
+// KeyProvider is configured. Should r fail before size bytes were read, the parts written already are
+// skipped by readers and their LSN is not used again.
+func (wal *WriteAheadLog) WriteRecordFrom(r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("record size cannot be negative")
+	}
+	if wal.codec != nil || wal.ciphers != nil {
+		return ErrStreamingUnsupported
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	_, err := wal.appendStream(r, size)
+	return err
+}
+
+// appendStream writes size bytes read from r as the next record and returns
+// its log sequence number. Must be called with wal.lock held.
+func (wal *WriteAheadLog) appendStream(r io.Reader, size int64) (uint64, error) {
+	logSeqNumber := wal.lastLogSequenceNumber + 1
+	timestamp := wal.nextTimestamp()
+	record := &wal.scratchRecord
+	record.LogSequenceNumber = logSeqNumber
+	record.Timestamp = timestamp
+	record.Codec = 0
+	record.KeyId = 0
+	if wal.chainHasher != nil {
+		record.PrevHash = wal.lastHash
+		startChainHash(wal.chainHasher, record)
+	}
+	defer func() { record.PrevHash, record.Blob = nil, nil }()
+
+	toBlob := wal.blobThreshold > 0 && size > int64(wal.blobThreshold)
+	if toBlob {
+		if err := wal.startBlob(logSeqNumber, size); err != nil {
+			return 0, err
+		}
+		wal.scratchBlob.File = wal.blobBaseLSN
+		wal.scratchBlob.Offset = wal.blobSize
+		wal.scratchBlob.Length = size
+		wal.scratchBlob.Checksum = 0
+	}
+
+	chunk := make([]byte, min(size, streamPartSize))
+	var part uint32
+	for remaining := size; ; {
+		data := chunk[:min(remaining, int64(len(chunk)))]
+		if _, err := io.ReadFull(r, data); err != nil {
+			if toBlob {
+				wal.discardBlob(wal.scratchBlob.Offset)
+			}
+			wal.abandonRecord(part)
+			return 0, fmt.Errorf("failed to read record data: %w", err)
+		}
+		remaining -= int64(len(data))
+		if wal.chainHasher != nil {
+			wal.chainHasher.Write(data)
+		}
+
+		if toBlob {
+			wal.scratchBlob.Checksum = crc32.Update(wal.scratchBlob.Checksum, crc32.IEEETable, data)
+			if err := wal.writeBlobData(data); err != nil {
+				wal.discardBlob(wal.scratchBlob.Offset)
+				return 0, err
+			}
+		} else {
+			// An empty record still gets a part
+			for first := true; first || len(data) > 0; first = false {
+				written, err := wal.writePart(data, part, remaining == 0)
+				if err != nil {
+					wal.abandonRecord(part)
+					return 0, err
+				}
+				data = data[written:]
+				part++
+			}
+		}
+		if remaining == 0 {
+			break
+		}
+	}
+
+	if toBlob {
+		// Only a pointer goes into the segment
+		record.Blob = &wal.scratchBlob
+		record.Checksum = recordChecksum(nil, logSeqNumber)
+		encodedRecord, err := gpb.MarshalOptions{}.MarshalAppend(append(wal.scratchBuffer[:0], 0, 0, 0, 0), record)
+		if err == nil {
+			wal.keepScratchBuffer(encodedRecord)
+			err = wal.writeRecord(encodedRecord, 0)
+		}
+		if err != nil {
+			wal.discardBlob(wal.scratchBlob.Offset)
+			return 0, err
+		}
+	}
+
+	wal.lastLogSequenceNumber = logSeqNumber
+	wal.lastTimestamp = timestamp
+	if wal.chainHasher != nil {
+		wal.nextHash = wal.chainHasher.Sum(wal.nextHash[:0])
+		wal.lastHash, wal.nextHash = wal.nextHash, wal.lastHash
+	}
+	return logSeqNumber, nil
+}
+
+// RecordReader reads the data of a record from its segments, see OpenRecord.
+type RecordReader struct {
+	iterator *RecordIterator
+	record   *pb.WalRecord // Part being read
+	data     []byte        // Data of the part not read yet
+	blob     File          // Blob file holding the data, nil when it is in the segments
+	blobData io.Reader     // Data of the blob not read yet
+	checksum uint32        // CRC-32 of the blob data read so far
+}
+
+// OpenRecord returns a reader over the data of the record with the given log
+// sequence number. Records stored raw, which includes all records written by
+// WriteRecordFrom, are read from their segments one part at a time or
+// straight from their blob file, while compressed or encrypted ones are
+// decoded as a whole first. Reading fails
+// with ErrCorruptRecord when parts turn out to be missing, because the record
+// never got its last part, and with ErrLSNNotFound when retention deleted
+// them meanwhile.
+func (wal *WriteAheadLog) OpenRecord(lsn uint64) (*RecordReader, error) {
+	iterator, err := wal.iterate(lsn, true)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := iterator.nextPart()
+	if err == io.EOF || (err == nil && (record.GetLogSequenceNumber() != lsn || record.GetPart() != 0)) {
+		err = fmt.Errorf("%w: %d", ErrLSNNotFound, lsn)
+	}
+	if err != nil {
+		iterator.Close()
+		return nil, err
+	}
+
+	reader := &RecordReader{iterator: iterator, record: record, data: record.GetData()}
+	if record.GetCodec() == 0 && record.GetKeyId() == 0 {
+		if record.GetBlob() == nil {
+			return reader, nil
+		}
+		if reader.blob, err = openBlob(iterator.fs, iterator.directory, record); err != nil {
+			iterator.Close()
+			return nil, err
+		}
+		reader.blobData = io.LimitReader(reader.blob, record.GetBlob().GetLength())
+		return reader, nil
+	}
+
+	// Decoding needs all of the data
+	var parts recordParts
+	for record = parts.add(record); record == nil; record = parts.add(reader.record) {
+		if reader.record, err = reader.nextPart(); err != nil {
+			iterator.Close()
+			return nil, err
+		}
+	}
+	err = readBlob(iterator.fs, iterator.directory, record)
+	if err == nil {
+		err = decodeRecord(record, iterator.ciphers)
+	}
+	if err != nil {
+		iterator.Close()
+		return nil, err
+	}
+	reader.record, reader.data = record, record.GetData()
+	return reader, nil
+}
+
+// LogSequenceNumber returns the log sequence number of the record.
+func (reader *RecordReader) LogSequenceNumber() uint64 {
+	return reader.record.GetLogSequenceNumber()
+}
+
+// Timestamp returns the timestamp of the record in nanoseconds.
+func (reader *RecordReader) Timestamp() int64 {
+	return reader.record.GetTimestamp()
+}
+
+// Read reads the next data of the record, loading its parts as it goes.
+func (reader *RecordReader) Read(p []byte) (int, error) {
+	if reader.blob != nil {
+		return reader.readBlob(p)
+	}
+
+	for len(reader.data) == 0 {
+		if !reader.record.GetContinued() {
+			return 0, io.EOF
+		}
+		part, err := reader.nextPart()
+		if err != nil {
+			return 0, err
+		}
+		reader.record, reader.data = part, part.GetData()
+	}
+
+	n := copy(p, reader.data)
+	reader.data = reader.data[n:]
+	return n, nil
+}
+
+// readBlob reads the next data from the blob file, checking it once all of it
+// was read.
+func (reader *RecordReader) readBlob(p []byte) (int, error) {
+	n, err := reader.blobData.Read(p)
+	reader.checksum = crc32.Update(reader.checksum, crc32.IEEETable, p[:n])
+	if err == io.EOF && reader.checksum != reader.record.GetBlob().GetChecksum() {
+		return n, fmt.Errorf("%w: blob of lsn %d does not match its checksum", ErrCorruptRecord, reader.record.GetLogSequenceNumber())
+	}
+	return n, err
+}
+
+// nextPart reads the part following the one being read.
+func (reader *RecordReader) nextPart() (*pb.WalRecord, error) {
+	part, err := reader.iterator.nextPart()
+	if err == io.EOF || (err == nil && !continues(reader.record, part)) {
+		return nil, fmt.Errorf("%w: record %d is missing parts", ErrCorruptRecord, reader.record.GetLogSequenceNumber())
+	}
+	return part, err
+}
+
+// Close releases the segment or blob file the reader has open.
+func (reader *RecordReader) Close() error {
+	if reader.blob != nil {
+		reader.blob.Close()
+	}
+	return reader.iterator.Close()
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	dsyncFlag  = syscall.O_DSYNC
+	directFlag = syscall.O_DIRECT
+)
+
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package wal
+
+import (
+	"os"
+)
+
+const (
+	dsyncFlag  = os.O_SYNC
+	directFlag = 0 // O_DIRECT is not supported
+)
+
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
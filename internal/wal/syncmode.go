@@ -0,0 +1,216 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// SyncMode selects the primitive that makes written records durable.
+type SyncMode int
+
+const (
+	SyncModeFsync     SyncMode = iota // fsync(2) after flushing, persists data and all metadata
+	SyncModeFdatasync                 // fdatasync(2), skips metadata such as mtime that is not needed to read the data back
+	SyncModeDsync                     // Segments are opened with O_DSYNC, so every write is durable when it returns
+	SyncModeDirect                    // O_DIRECT|O_DSYNC with block aligned writes that bypass the page cache (Linux only)
+)
+
+func (mode SyncMode) String() string {
+	switch mode {
+	case SyncModeFsync:
+		return "fsync"
+	case SyncModeFdatasync:
+		return "fdatasync"
+	case SyncModeDsync:
+		return "dsync"
+	case SyncModeDirect:
+		return "direct"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(mode))
+}
+
+// Supported reports whether the mode can be used on this platform.
+func (mode SyncMode) Supported() bool {
+	return mode != SyncModeDirect || directFlag != 0
+}
+
+// openFlags returns the extra flags segments are opened with for writing.
+func (mode SyncMode) openFlags() int {
+	switch mode {
+	case SyncModeDsync:
+		return dsyncFlag
+	case SyncModeDirect:
+		return directFlag | dsyncFlag
+	}
+	return 0
+}
+
+// writesAreDurable reports whether a completed write is already durable, so
+// no separate sync call is needed.
+func (mode SyncMode) writesAreDurable() bool {
+	return mode == SyncModeDsync || mode == SyncModeDirect
+}
+
+// datasyncer is implemented by files that can sync data without metadata.
+type datasyncer interface {
+	Datasync() error
+}
+
+// datasyncFile makes the file contents durable, falling back to a full sync
+// where fdatasync is not available.
+func datasyncFile(file File) error {
+	switch file := file.(type) {
+	case datasyncer:
+		return file.Datasync()
+	case *os.File:
+		return fdatasync(file)
+	default:
+		return file.Sync()
+	}
+}
+
+// segmentWriter buffers records in front of the current segment file.
+type segmentWriter interface {
+	io.Writer
+	Flush() error
+	Buffered() int
+}
+
+// newSegmentWriter returns the writer for a segment whose records end at offset.
+func (wal *WriteAheadLog) newSegmentWriter(file File, offset int64) (segmentWriter, error) {
+	if wal.syncMode != SyncModeDirect {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek: %w", err)
+		}
+		return bufio.NewWriter(blobsFirstWriter{wal: wal, file: file}), nil
+	}
+
+	// O_DIRECT can only write whole blocks, so the partial block holding the
+	// last records has to be rewritten along with the next ones
+	blockStart := offset - offset%directBlockSize
+	partialBlock := make([]byte, offset-blockStart)
+	if len(partialBlock) > 0 {
+		reader, err := wal.fs.OpenFile(file.Name(), os.O_RDONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		if _, err := reader.Seek(blockStart, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek: %w", err)
+		}
+		if _, err := io.ReadFull(reader, partialBlock); err != nil {
+			return nil, fmt.Errorf("failed to read partial block: %w", err)
+		}
+	}
+
+	return newDirectWriter(file, blockStart, partialBlock), nil
+}
+
+// blobsFirstWriter writes to a segment file once the blobs its records may
+// point to are durable, so a crash never keeps a record whose blob it lost.
+// The buffer writes through it on every flush, including when it runs full.
+type blobsFirstWriter struct {
+	wal  *WriteAheadLog
+	file File
+}
+
+func (writer blobsFirstWriter) Write(data []byte) (int, error) {
+	if err := writer.wal.syncBlobFile(); err != nil {
+		// Sticky like a failed sync, see sync
+		writer.wal.syncErr = err
+		return 0, err
+	}
+	return writer.file.Write(data)
+}
+
+const (
+	directBlockSize  = 4096      // Alignment O_DIRECT needs for offsets, lengths and memory
+	directBufferSize = 64 * 1024 // Size of the aligned buffer, a multiple of directBlockSize
+)
+
+// directWriter replaces bufio.Writer for O_DIRECT segments. It collects
+// records in a block aligned buffer and only writes whole blocks: a partial
+// last block is written padded with zeros, which readers take as the end of
+// the records, and rewritten by the next flush.
+type directWriter struct {
+	file       File
+	buffer     []byte // Aligned buffer, buffer[:length] holds the data from blockStart on
+	blockStart int64  // File offset of buffer[0], always block aligned
+	length     int    // Bytes of data in the buffer
+	written    int    // Bytes of data in the buffer that are already in the file
+}
+
+func newDirectWriter(file File, blockStart int64, partialBlock []byte) *directWriter {
+	writer := &directWriter{
+		file:       file,
+		buffer:     alignedBuffer(directBufferSize),
+		blockStart: blockStart,
+	}
+	writer.length = copy(writer.buffer, partialBlock)
+	writer.written = writer.length
+	return writer
+}
+
+func alignedBuffer(size int) []byte {
+	buffer := make([]byte, size+directBlockSize)
+	misalignment := int(uintptr(unsafe.Pointer(&buffer[0])) % directBlockSize)
+	offset := 0
+	if misalignment != 0 {
+		offset = directBlockSize - misalignment
+	}
+	return buffer[offset : offset+size : offset+size]
+}
+
+func (writer *directWriter) Write(data []byte) (int, error) {
+	total := len(data)
+	for len(data) > 0 {
+		copied := copy(writer.buffer[writer.length:], data)
+		writer.length += copied
+		data = data[copied:]
+
+		if writer.length == len(writer.buffer) {
+			if err := writer.writeBlocks(writer.length); err != nil {
+				return total - len(data), err
+			}
+			writer.blockStart += int64(writer.length)
+			writer.length, writer.written = 0, 0
+		}
+	}
+	return total, nil
+}
+
+// Flush writes the buffered data, padding the last block with zeros. The data
+// of that block stays in the buffer.
+func (writer *directWriter) Flush() error {
+	if writer.written == writer.length {
+		return nil
+	}
+
+	paddedLength := (writer.length + directBlockSize - 1) / directBlockSize * directBlockSize
+	clear(writer.buffer[writer.length:paddedLength])
+	if err := writer.writeBlocks(paddedLength); err != nil {
+		return err
+	}
+
+	fullBlocks := writer.length / directBlockSize * directBlockSize
+	writer.length = copy(writer.buffer, writer.buffer[fullBlocks:writer.length])
+	writer.blockStart += int64(fullBlocks)
+	writer.written = writer.length
+	return nil
+}
+
+func (writer *directWriter) Buffered() int {
+	return writer.length - writer.written
+}
+
+func (writer *directWriter) writeBlocks(length int) error {
+	if _, err := writer.file.Seek(writer.blockStart, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek: %w", err)
+	}
+	_, err := writer.file.Write(writer.buffer[:length])
+	return err
+}
@@ -0,0 +1,83 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"time"
+	pb "walstore/proto"
+)
+
+// FindLSNByTime returns the log sequence number of the last record written at
+// or before t. It relies on record timestamps not going backwards, which
+// Config.MonotonicTimestamps guarantees, and reads at most
+// Config.IndexInterval records once the index located the segment.
+func (wal *WriteAheadLog) FindLSNByTime(t time.Time) (uint64, error) {
+	timestamp := t.UnixNano()
+
+	entry, found := wal.seekTime(timestamp)
+	if !found {
+		return 0, fmt.Errorf("%w: no record written at or before %s", ErrLSNNotFound, t.Format(time.RFC3339Nano))
+	}
+
+	iterator, err := wal.Iterate(entry.lsn)
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+
+	lsn := entry.lsn
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF || (err == nil && record.GetTimestamp() > timestamp) {
+			return lsn, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		lsn = record.GetLogSequenceNumber()
+	}
+}
+
+// seekTime returns the last index entry written at or before timestamp, from
+// the newest segment whose first record is not newer than timestamp.
+func (wal *WriteAheadLog) seekTime(timestamp int64) (indexEntry, bool) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	for i := len(wal.segments) - 1; i >= 0; i-- {
+		index := wal.segments[i]
+		if !index.empty() && index.firstTimestamp <= timestamp {
+			return index.seekTime(timestamp), true
+		}
+	}
+	return indexEntry{}, false
+}
+
+// ReplayUntil calls apply for every record written at or before t, oldest
+// first, to restore the state as of t. It fails with ErrLSNNotFound when no
+// record that old is left in the WAL, and stops at the first error of apply.
+func (wal *WriteAheadLog) ReplayUntil(t time.Time, apply func(*pb.WalRecord) error) error {
+	lastLSN, err := wal.FindLSNByTime(t)
+	if err != nil {
+		return err
+	}
+
+	iterator, err := wal.Iterate(0)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF || (err == nil && record.GetLogSequenceNumber() > lastLSN) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := apply(record); err != nil {
+			return err
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package wal
 
 import (
-	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"time"
 	pb "walstore/proto"
 
@@ -20,128 +23,435 @@ var (
 	SegmentPrefix = "wal-segment-"         // Default segment file prefix
 )
 
+const maxScratchBufferSize = 1024 * 1024 // Largest encoding buffer kept between writes
+
+// ErrBackpressure is returned by writes that would exceed Config.MaxInFlightBytes
+// when Config.RejectWhenFull is set.
+var ErrBackpressure = errors.New("too many unsynced bytes in flight")
+
+// ErrCorruptRecord is returned when a record is torn, cannot be decoded or
+// fails its checksum.
+var ErrCorruptRecord = errors.New("corrupt WAL record")
+
 func StartLogger(config *Config) (*WriteAheadLog, error) {
+	syncInterval := SyncInterval
 	if config.SyncInterval > 0 {
-		SyncInterval = time.Duration(config.SyncInterval) * time.Millisecond
+		syncInterval = time.Duration(config.SyncInterval) * time.Millisecond
 	}
 
 	if err := validateConfig(config); err != nil {
 		return nil, err
 	}
 
-	if err := os.MkdirAll(config.Directory, 0755); err != nil {
-		return nil, err
+	indexInterval := defaultIndexInterval
+	if config.IndexInterval > 0 {
+		indexInterval = config.IndexInterval
+	}
+	compressionThreshold := defaultCompressionThreshold
+	if config.CompressionThreshold > 0 {
+		compressionThreshold = config.CompressionThreshold
 	}
 
-	segmentFile, segmentNumber, err := loadLastSegmentFile(config)
-	if err != nil {
+	// Fill in defaults on a copy, so the caller's config can be reused as is
+	configCopy := *config
+	config = &configCopy
+	if config.FS == nil {
+		config.FS = OSFS{}
+	}
+
+	if config.Clock == nil {
+		config.Clock = SystemClock{}
+	}
+
+	if err := config.FS.MkdirAll(config.Directory, 0755); err != nil {
 		return nil, err
 	}
 
-	// seek to the end of the file to start writing new records
-	if _, err := segmentFile.Seek(0, io.SeekEnd); err != nil {
-		return nil, fmt.Errorf("failed to seek: %w", err)
+	// Make sure the WAL directory itself survives a power loss
+	if err := config.FS.SyncDir(filepath.Dir(filepath.Clean(config.Directory))); err != nil {
+		return nil, fmt.Errorf("failed to sync parent directory: %w", err)
+	}
+
+	if config.SegmentNaming == SegmentNamingBaseLSN {
+		if err := MigrateSegmentNames(config.FS, config.Directory); err != nil {
+			return nil, fmt.Errorf("failed to migrate segment names: %w", err)
+		}
+	}
+
+	segmentFile, segmentNumber, segmentSize, err := loadLastSegmentFile(config)
+	if err != nil {
+		return nil, err
 	}
 
 	context, cancel := context.WithCancel(context.Background())
 
 	wal := &WriteAheadLog{
 		directory:             config.Directory,
+		fs:                    config.FS,
 		currSegmentFile:       segmentFile,
 		currSegmentNumber:     segmentNumber,
+		currSegmentSize:       segmentSize,
 		maxFileSize:           config.MaxFileSize,
 		maxSegments:           config.MaxSegments,
+		preallocate:           config.PreallocateSegments,
+		recycleSegments:       config.RecycleSegments,
+		syncMode:              config.SyncMode,
 		shouldForceSync:       config.EnableForceSync,
 		lastLogSequenceNumber: 0,
-		bufferWriter:          bufio.NewWriter(segmentFile),
-		syncTimer:             time.NewTimer(SyncInterval),
+		clock:                 config.Clock,
+		syncInterval:          syncInterval,
+		syncTimer:             config.Clock.NewTimer(syncInterval),
 		context:               context,
 		cancel:                cancel,
+		lock:                  newContextMutex(),
+		maxInFlightBytes:      config.MaxInFlightBytes,
+		rejectWhenFull:        config.RejectWhenFull,
+		indexInterval:         indexInterval,
+		segmentNaming:         config.SegmentNaming,
+		monotonicTimestamps:   config.MonotonicTimestamps,
+		codec:                 config.Codec,
+		compressionThreshold:  compressionThreshold,
+		ciphers:               newCipherCache(config.KeyProvider),
+		chainKey:              config.ChainKey,
+		scrubInterval:         config.ScrubInterval,
+		scrubRate:             config.ScrubRate,
+		scrubDone:             make(chan struct{}),
+		framing:               config.Framing,
+		blockFraming:          config.Framing == FramingBlocks,
+		blobThreshold:         config.BlobThreshold,
+		maxSegmentAge:         config.MaxSegmentAge,
+		appendQueue:           make(chan *AppendFuture, appendQueueSize),
+		writerDone:            make(chan struct{}),
+	}
+
+	// Release what was opened so far when starting fails
+	started := false
+	defer func() {
+		if !started {
+			wal.cancel()
+			wal.syncTimer.Stop()
+			wal.closeFiles()
+		}
+	}()
+
+	// The current segment keeps the framing its records were written with
+	if segmentSize > 0 {
+		framing, err := readFraming(config.FS, segmentFile.Name())
+		if err != nil {
+			return nil, err
+		}
+		wal.blockFraming = framing == FramingBlocks
 	}
 
-	if wal.lastLogSequenceNumber, err = wal.getLastLogSequenceNumber(); err != nil {
+	// start writing new records at the end of the existing ones, the file
+	// itself can be longer when it was preallocated or recycled
+	if wal.bufferWriter, err = wal.newSegmentWriter(segmentFile, segmentSize); err != nil {
+		return nil, err
+	}
+
+	if err := wal.loadSegmentIndexes(); err != nil {
 		return nil, fmt.Errorf("failed getting lsn: %w", err)
 	}
+	wal.lastSyncedLSN = wal.lastLogSequenceNumber
+
+	if err := wal.collectBlobFiles(); err != nil {
+		return nil, fmt.Errorf("failed to remove unused blob files: %w", err)
+	}
 
+	if config.HashChain {
+		wal.chainHasher = newChainHasher(config.ChainKey)
+		if err := wal.loadChainHead(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Hooks != nil {
+		wal.hooks = newHookQueue(config.Hooks)
+	}
+
+	started = true
 	go wal.syncPeriodically()
+	go wal.writeAppendedRecords()
+	if wal.scrubInterval > 0 {
+		go wal.scrubPeriodically(wal.clock.NewTimer(wal.scrubInterval))
+	} else {
+		close(wal.scrubDone)
+	}
 
 	return wal, nil
 }
 
+// ReadAllRecords reads the records of the current segment, oldest first.
+// Records split into parts that started in an earlier segment are left out;
+// ReadAllSegments reads every segment.
 func (wal *WriteAheadLog) ReadAllRecords() ([]*pb.WalRecord, error) {
-	file, err := os.OpenFile(wal.currSegmentFile.Name(), os.O_RDONLY, 0644)
+	wal.lock.Lock()
+	currSegmentPath := wal.currSegmentFile.Name()
+	wal.lock.Unlock()
+
+	return wal.readSegments([]string{currSegmentPath})
+}
+
+// ReadAllSegments reads the records of every segment, oldest first.
+func (wal *WriteAheadLog) ReadAllSegments() ([]*pb.WalRecord, error) {
+	segmentFiles, err := listSegmentFiles(wal.fs, wal.directory, wal.segmentNaming)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open WAL segment file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
+	return wal.readSegments(segmentFiles)
+}
+
+// readSegments reads the records of the given segments, which are in order.
+func (wal *WriteAheadLog) readSegments(segmentFiles []string) ([]*pb.WalRecord, error) {
+	// Behind the flushed records of the current segment there can be stale
+	// bytes from a recycled segment, so never read past them
+	wal.lock.Lock()
+	currSegmentPath := wal.currSegmentFile.Name()
+	currSegmentFlushed := wal.currSegmentSize - int64(wal.bufferWriter.Buffered())
+	wal.lock.Unlock()
+
 	var walRecords []*pb.WalRecord
+	var parts recordParts
+	for _, segmentFile := range segmentFiles {
+		limit := int64(-1)
+		if segmentFile == currSegmentPath {
+			limit = currSegmentFlushed
+		}
 
-	for {
-		var recordSize int32
-		// Read the size of the next record
-		if err := binary.Read(file, binary.LittleEndian, &recordSize); err != nil {
-			if err == io.EOF {
-				// End of file reached, break the loop
-				break
+		records, _, err := scanSegment(wal.fs, segmentFile, limit)
+		for _, record := range records {
+			if record = parts.add(record); record == nil {
+				continue
+			}
+			if err := readBlob(wal.fs, wal.directory, record); err != nil {
+				return walRecords, err
+			}
+			if err := decodeRecord(record, wal.ciphers); err != nil {
+				return walRecords, err
+			}
+			walRecords = append(walRecords, record)
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Deleted by retention while we were reading
+				continue
 			}
 			return walRecords, err
 		}
+	}
 
-		data := make([]byte, recordSize)
-		// Read the record data
-		if _, err := io.ReadFull(file, data); err != nil {
-			return walRecords, err
+	return walRecords, nil
+}
+
+func readSegmentRecords(fs FS, segmentPath string) ([]*pb.WalRecord, error) {
+	records, _, err := scanSegment(fs, segmentPath, -1)
+	return records, err
+}
+
+// scanSegment reads and verifies the records of a segment, stopping at the
+// end of the file, at a segment terminator or once limit bytes were read when
+// limit is not negative. It also returns the offset right after the last valid
+// record, which is where a torn tail starts.
+func scanSegment(fs FS, segmentPath string, limit int64) ([]*pb.WalRecord, int64, error) {
+	reader, err := openSegmentReader(fs, segmentPath, 0, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open WAL segment file: %w", err)
+	}
+	defer reader.close()
+
+	var walRecords []*pb.WalRecord
+	for {
+		record, _, err := reader.next()
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			return walRecords, reader.offset, err
+		}
+		walRecords = append(walRecords, record)
+	}
 
-		var record pb.WalRecord
-		if err := gpb.Unmarshal(data, &record); err != nil {
-			return walRecords, err
+	return walRecords, reader.offset, nil
+}
+
+// repairSegmentFile cuts off a torn or corrupted tail left behind by a crash
+// and returns the size of the valid records. Segments that keep their space,
+// because they are preallocated or recycled, get a terminator instead of
+// being truncated. In segments framed in blocks, damage followed by intact
+// records is no tail, only what follows the last intact record is cut off.
+// Records whose blob did not make it to directory are part of the tail.
+func repairSegmentFile(fs FS, directory string, segmentPath string, keepSpace bool) (int64, error) {
+	index, err := buildSegmentIndex(fs, segmentPath, 0, defaultIndexInterval)
+	if index == nil || (err != nil && !errors.Is(err, ErrCorruptRecord)) {
+		return 0, err
+	}
+	validSize := index.size
+	// Blobs are durable before the records pointing to them, unless the
+	// crash came without any fsync
+	if blobSize, blobErr := firstLostBlob(fs, directory, segmentPath, validSize); blobErr != nil {
+		if !errors.Is(blobErr, ErrCorruptRecord) {
+			return 0, blobErr
 		}
+		validSize, err = blobSize, blobErr
+	}
+	if err == nil {
+		return validSize, nil
+	}
+
+	fmt.Printf("Truncating WAL segment %s at offset %d: %v\n", segmentPath, validSize, err)
 
-		walRecords = append(walRecords, &record)
+	file, err := fs.OpenFile(segmentPath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
 	}
+	defer file.Close()
 
-	return walRecords, nil
+	if keepSpace {
+		err = terminateSegment(file, validSize)
+	} else {
+		err = file.Truncate(validSize)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	return validSize, file.Sync()
+}
+
+func recordChecksum(data []byte, logSeqNumber uint64) uint32 {
+	checksum := ^crc32.ChecksumIEEE(data)
+	// Same as crc32.Update with the single LSN byte, without allocating a slice for it
+	checksum = crc32.IEEETable[byte(checksum)^byte(logSeqNumber)] ^ (checksum >> 8)
+	return ^checksum
 }
 
 func (wal *WriteAheadLog) WriteRecord(data []byte) error {
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
 
-	logSeqNumber := wal.lastLogSequenceNumber + 1
+	_, err := wal.appendRecord(data)
+	return err
+}
 
-	newRecord := &pb.WalRecord{
-		Data:              data,
-		LogSequenceNumber: logSeqNumber,
-		Timestamp:         time.Now().UnixNano(),
-		Checksum:          crc32.ChecksumIEEE(append(data, byte(logSeqNumber))),
+// WriteRecordContext writes data and waits until it is durable. It gives up
+// when ctx ends while waiting for the lock or for the sync; in the latter case
+// the record was written and may still become durable. Once a sync failed, it
+// returns that sync's error, see Sync.
+func (wal *WriteAheadLog) WriteRecordContext(ctx context.Context, data []byte) error {
+	if err := wal.lock.LockContext(ctx); err != nil {
+		return err
 	}
-
-	marshaledRecord, err := gpb.Marshal(newRecord)
+	logSeqNumber, err := wal.appendRecord(data)
+	wal.lock.Unlock()
 	if err != nil {
 		return err
 	}
 
-	if err := wal.rotateLogIfNeeded(len(marshaledRecord)); err != nil {
+	return wal.syncThrough(ctx, logSeqNumber)
+}
+
+// syncThrough makes the records up to logSeqNumber durable. Writers queued
+// behind us on the lock share the sync of whoever gets the lock first.
+func (wal *WriteAheadLog) syncThrough(ctx context.Context, logSeqNumber uint64) error {
+	if err := wal.lock.LockContext(ctx); err != nil {
 		return err
 	}
+	defer wal.lock.Unlock()
 
-	if err := wal.writeToBuffer(marshaledRecord); err != nil {
-		return err
+	if wal.lastSyncedLSN >= logSeqNumber {
+		return nil
+	}
+	return wal.sync()
+}
+
+// appendRecord writes data as the next record and returns its log sequence
+// number. Must be called with wal.lock held.
+func (wal *WriteAheadLog) appendRecord(data []byte) (uint64, error) {
+	logSeqNumber := wal.lastLogSequenceNumber + 1
+
+	// Reuse the record and the encoding buffer, so writing does not allocate
+	storedData, codecID, err := wal.compress(data)
+	if err != nil {
+		return 0, err
+	}
+	storedData, keyID, err := wal.encrypt(storedData, logSeqNumber)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := wal.nextTimestamp()
+	wal.scratchRecord.Data = storedData
+	wal.scratchRecord.LogSequenceNumber = logSeqNumber
+	wal.scratchRecord.Timestamp = timestamp
+	wal.scratchRecord.Checksum = recordChecksum(storedData, logSeqNumber)
+	wal.scratchRecord.Codec = codecID
+	wal.scratchRecord.KeyId = keyID
+	if wal.chainHasher != nil {
+		wal.scratchRecord.PrevHash = wal.lastHash
+		wal.nextHash = chainHash(wal.chainHasher, &wal.scratchRecord, wal.nextHash[:0])
+	}
+	if wal.blobThreshold > 0 && len(storedData) > wal.blobThreshold {
+		// Only a pointer goes into the segment, the hash chain still covers the data
+		wal.scratchRecord.Blob, err = wal.writeBlob(storedData, logSeqNumber)
+		wal.scratchRecord.Data = nil
+		wal.scratchRecord.Checksum = recordChecksum(nil, logSeqNumber)
+	}
+
+	// Leave room for the length header in front of the record
+	var encodedRecord []byte
+	if err == nil {
+		encodedRecord, err = gpb.MarshalOptions{}.MarshalAppend(append(wal.scratchBuffer[:0], 0, 0, 0, 0), &wal.scratchRecord)
+	}
+	if err == nil {
+		wal.keepScratchBuffer(encodedRecord)
+		if wal.fitsEmptySegment(len(encodedRecord) - 4) {
+			err = wal.writeRecord(encodedRecord, len(wal.scratchRecord.Data))
+		} else {
+			err = wal.appendParts(storedData)
+		}
 	}
+	if err != nil && wal.scratchRecord.Blob != nil {
+		wal.discardBlob(wal.scratchBlob.Offset)
+	}
+	wal.scratchRecord.Data = nil // Do not hold on to the caller's data
+	wal.scratchRecord.PrevHash = nil
+	wal.scratchRecord.Blob = nil
+	if err != nil {
+		return 0, err
+	}
+
 	wal.lastLogSequenceNumber = logSeqNumber
-	return nil
+	wal.lastTimestamp = timestamp
+	if wal.chainHasher != nil {
+		wal.lastHash, wal.nextHash = wal.nextHash, wal.lastHash
+	}
+	return logSeqNumber, nil
 }
 
-func (wal *WriteAheadLog) rotateLogIfNeeded(currDataLength int) error {
-	fileInfo, err := wal.currSegmentFile.Stat()
+// writeRecord writes the encoded record in wal.scratchRecord, holding
+// payloadSize bytes of data, to the current segment or the next one.
+func (wal *WriteAheadLog) writeRecord(encodedRecord []byte, payloadSize int) error {
+	if err := wal.reserveInFlight(int64(len(encodedRecord))); err != nil {
+		return err
+	}
+
+	if err := wal.rotateLogIfNeeded(len(encodedRecord) - 4); err != nil {
+		return err
+	}
+
+	recordOffset, err := wal.writeToBuffer(encodedRecord)
 	if err != nil {
 		return err
 	}
+	wal.currentIndex().add(wal.scratchRecord.LogSequenceNumber, recordOffset, wal.scratchRecord.Timestamp, payloadSize, wal.indexInterval)
+	return nil
+}
 
-	bufferSizeWouldBe := fileInfo.Size() + int64(wal.bufferWriter.Buffered()) + int64(currDataLength)
+func (wal *WriteAheadLog) rotateLogIfNeeded(currDataLength int) error {
+	// Keep room for the footer written when the segment is sealed
+	bufferSizeWouldBe := wal.currSegmentSize + wal.framedSize(currDataLength) + footerReserve
 
-	if bufferSizeWouldBe >= wal.maxFileSize {
+	// Records too large for any segment are split into parts beforehand,
+	// rotating an empty segment would only leave it behind
+	if bufferSizeWouldBe >= wal.maxFileSize && wal.currSegmentSize > 0 {
 		if err := wal.rotateLog(); err != nil {
 			return err
 		}
@@ -151,65 +461,259 @@ func (wal *WriteAheadLog) rotateLogIfNeeded(currDataLength int) error {
 }
 
 func (wal *WriteAheadLog) rotateLog() error {
-	if err := wal.Sync(); err != nil {
+	if err := wal.sealSegment(true); err != nil {
+		return err
+	}
+
+	sealedSegment := wal.currentSegmentInfo()
+
+	// Create the next segment before giving up the current one, so a failure
+	// leaves the WAL writing to a valid segment
+	nextSegmentNumber := wal.nextSegmentNumber()
+	newSegmentFile, err := wal.openNextSegmentFile(nextSegmentNumber)
+	if err != nil {
+		// Keep appending to the current segment, after its records rather
+		// than after the footer written by sealSegment
+		if writer, resetErr := wal.newSegmentWriter(wal.currSegmentFile, wal.currSegmentSize); resetErr == nil {
+			wal.bufferWriter = writer
+		}
+		return fmt.Errorf("failed to create new segment file: %w", err)
+	}
+
+	newBufferWriter, err := wal.newSegmentWriter(newSegmentFile, 0)
+	if err != nil {
+		newSegmentFile.Close()
 		return err
 	}
 
 	if err := wal.currSegmentFile.Close(); err != nil {
+		newSegmentFile.Close()
 		return err
 	}
 
-	if wal.currSegmentNumber+1 > wal.maxSegments {
-		if err := wal.deleteOldestSegmentFile(); err != nil {
-			return err
+	// The sealed segment will not change anymore, persist its index
+	sealedIndex := wal.currentIndex()
+	sealedIndex.size = wal.currSegmentSize
+	sealedIndex.sealed = true
+	if err := writeIndexFile(wal.fs, sealedIndex, wal.indexInterval); err != nil {
+		fmt.Printf("Error writing WAL index for %s: %v\n", sealedIndex.path, err)
+	}
+
+	wal.currSegmentFile = newSegmentFile
+	wal.bufferWriter = newBufferWriter
+	wal.currSegmentNumber = nextSegmentNumber
+	wal.currSegmentSize = 0
+	wal.blockFraming = wal.framing == FramingBlocks
+	wal.segments = append(wal.segments, newSegmentIndex(newSegmentFile.Name(), wal.lastLogSequenceNumber))
+
+	nextSegment := SegmentInfo{Path: newSegmentFile.Name()}
+	wal.hooks.push(func(hooks Hooks) { hooks.OnRotate(sealedSegment, nextSegment) })
+
+	return wal.applyRetention()
+}
+
+// nextSegmentNumber returns the number of the segment that follows the
+// current one. With base LSN names that is the LSN of the next record; should
+// a crash without EnableForceSync have lost records the current segment's name
+// already covers, the number still has to grow to keep names ordered.
+func (wal *WriteAheadLog) nextSegmentNumber() uint64 {
+	if wal.segmentNaming == SegmentNamingBaseLSN {
+		return max(wal.lastLogSequenceNumber+1, wal.currSegmentNumber+1)
+	}
+	return wal.currSegmentNumber + 1
+}
+
+// openNextSegmentFile creates the segment that follows the current one, or
+// recycles the oldest segment into it when retention would delete that anyway.
+func (wal *WriteAheadLog) openNextSegmentFile(nextSegmentNumber uint64) (File, error) {
+	if wal.recycleSegments {
+		files, err := listSegmentFiles(wal.fs, wal.directory, wal.segmentNaming)
+		if err != nil {
+			return nil, err
+		}
+		// The current segment is never recycled
+		if wal.maxSegments > 0 && len(files) >= wal.maxSegments && len(files) > 1 {
+			nextSegmentPath := filepath.Join(wal.directory, wal.segmentNaming.fileName(nextSegmentNumber))
+			return wal.recycleSegmentFile(files[0], nextSegmentPath)
 		}
 	}
 
-	newSegmentFile, err := createNewSegmentFile(wal.directory, wal.currSegmentNumber+1)
-	if err != nil {
-		return fmt.Errorf("failed to create new segment file: %w", err)
+	var preallocateSize int64
+	if wal.preallocate {
+		preallocateSize = wal.maxFileSize
 	}
+	nextSegmentPath := filepath.Join(wal.directory, wal.segmentNaming.fileName(nextSegmentNumber))
+	return createNewSegmentFile(wal.fs, nextSegmentPath, preallocateSize, wal.syncMode.openFlags())
+}
 
-	wal.currSegmentFile = newSegmentFile
-	wal.bufferWriter = bufio.NewWriter(newSegmentFile)
-	wal.currSegmentNumber++
+// sealSegment makes the current segment durable. A segment that is done for
+// good gets its footer, otherwise with recycling the records are followed by a
+// terminator, since stale records from the segment's previous life may come
+// after them.
+func (wal *WriteAheadLog) sealSegment(final bool) error {
+	if final {
+		if err := wal.writeFooter(); err != nil {
+			return err
+		}
+	} else if wal.recycleSegments {
+		if _, err := wal.bufferWriter.Write(segmentTerminator); err != nil {
+			return fmt.Errorf("failed to write segment terminator: %w", err)
+		}
+	}
 
-	return nil
+	return wal.sync()
 }
 
-func (wal *WriteAheadLog) deleteOldestSegmentFile() error {
-	files, err := filepath.Glob(filepath.Join(wal.directory, SegmentPrefix+"*"))
-	if err != nil {
+// applyRetention deletes the segments retention no longer keeps, and the blob
+// files only they pointed into.
+func (wal *WriteAheadLog) applyRetention() error {
+	if err := wal.deleteOldestSegmentFiles(); err != nil {
+		return err
+	}
+	if err := wal.deleteExpiredSegmentFiles(); err != nil {
 		return err
 	}
+	return wal.collectBlobFiles()
+}
 
-	if len(files) == 0 {
+// expireSegments applies retention outside of rotation, so segments also age
+// out of a WAL nobody writes to.
+func (wal *WriteAheadLog) expireSegments() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.applyRetention()
+}
+
+// deleteExpiredSegmentFiles removes the oldest sealed segments whose newest
+// record is older than maxSegmentAge by the WAL's clock.
+func (wal *WriteAheadLog) deleteExpiredSegmentFiles() error {
+	if wal.maxSegmentAge == 0 {
 		return nil
 	}
 
-	oldestSegmentFile, err := getOldestSegmentFile(files)
+	cutoff := wal.clock.Now().Add(-wal.maxSegmentAge).UnixNano()
+	// The current segment is never deleted
+	for len(wal.segments) > 1 && wal.segments[0].lastTimestamp < cutoff {
+		if err := wal.deleteSegmentFile(wal.segments[0].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOldestSegmentFiles removes the oldest segments until at most
+// maxSegments are left, 0 keeping them all. The current segment is never
+// deleted.
+func (wal *WriteAheadLog) deleteOldestSegmentFiles() error {
+	if wal.maxSegments == 0 {
+		return nil
+	}
+	files, err := wal.fs.Glob(filepath.Join(wal.directory, wal.segmentNaming.pattern()))
 	if err != nil {
 		return err
 	}
 
-	if err := os.Remove(oldestSegmentFile); err != nil {
+	// The current segment counts towards maxSegments
+	currSegmentPath := wal.currSegmentFile.Name()
+	files = slices.DeleteFunc(files, func(file string) bool { return file == currSegmentPath })
+	for len(files) > 0 && len(files)+1 > wal.maxSegments {
+		oldestSegmentFile, err := getOldestSegmentFile(files, wal.segmentNaming)
+		if err != nil {
+			return err
+		}
+
+		if err := wal.deleteSegmentFile(oldestSegmentFile); err != nil {
+			return err
+		}
+
+		files = slices.DeleteFunc(files, func(file string) bool { return file == oldestSegmentFile })
+	}
+
+	return nil
+}
+
+func (wal *WriteAheadLog) deleteSegmentFile(oldestSegmentFile string) error {
+	// Only pay for reading the segment when somebody is listening
+	var deletedSegment SegmentInfo
+	if wal.hooks != nil {
+		var err error
+		if deletedSegment, err = wal.segmentInfo(oldestSegmentFile); err != nil {
+			return err
+		}
+	}
+
+	if err := wal.fs.Remove(oldestSegmentFile); err != nil {
 		return err
 	}
+	wal.dropSegmentIndex(oldestSegmentFile)
+
+	// Without this the segment can reappear after a power loss
+	if err := wal.fs.SyncDir(wal.directory); err != nil {
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+
+	wal.hooks.push(func(hooks Hooks) { hooks.OnSegmentDeleted(deletedSegment) })
 
 	return nil
 }
 
-func getOldestSegmentFile(files []string) (string, error) {
+// readSegmentInfo scans a segment file to find the range of records it holds.
+func readSegmentInfo(fs FS, segmentPath string) (SegmentInfo, error) {
+	segment := SegmentInfo{Path: segmentPath}
+
+	records, validSize, err := scanSegment(fs, segmentPath, -1)
+	if err != nil {
+		return segment, fmt.Errorf("failed reading segment %s: %w", segmentPath, err)
+	}
+	segment.Size = validSize
+	if len(records) > 0 {
+		segment.FirstLSN = records[0].GetLogSequenceNumber()
+		segment.LastLSN = records[len(records)-1].GetLogSequenceNumber()
+	}
+
+	return segment, nil
+}
+
+// segmentInfo describes a sealed segment from its footer, and falls back to
+// scanning it for segments without one.
+func (wal *WriteAheadLog) segmentInfo(segmentPath string) (SegmentInfo, error) {
+	for _, index := range wal.segments {
+		if index.path != segmentPath {
+			continue
+		}
+		if footer, err := readSegmentFooter(wal.fs, segmentPath, index.size); err == nil {
+			return SegmentInfo{Path: segmentPath, FirstLSN: footer.FirstLSN, LastLSN: footer.LastLSN, Size: footer.DataSize}, nil
+		}
+	}
+	return readSegmentInfo(wal.fs, segmentPath)
+}
+
+// currentSegmentInfo describes the records of the current segment.
+func (wal *WriteAheadLog) currentSegmentInfo() SegmentInfo {
+	segment := SegmentInfo{
+		Path: wal.currSegmentFile.Name(),
+		Size: wal.currSegmentSize,
+	}
+	if index := wal.currentIndex(); !index.empty() {
+		segment.FirstLSN = index.firstLSN
+		segment.LastLSN = index.lastLSN
+	}
+
+	return segment
+}
+
+func getOldestSegmentFile(files []string, naming SegmentNaming) (string, error) {
 	if len(files) == 0 {
 		return "", nil
 	}
 
 	var oldestFile string
-	oldestSegmentNumber := int(^uint(0) >> 1) // Max int value
+	oldestSegmentNumber := uint64(math.MaxUint64)
 	for _, file := range files {
-		var segmentNumber int
-		if _, err := fmt.Sscanf(filepath.Base(file), SegmentPrefix+"%d.log", &segmentNumber); err != nil {
-			return "", fmt.Errorf("failed to parse segment number from file %s: %w", file, err)
+		segmentNumber, err := naming.parse(file)
+		if err != nil {
+			return "", err
 		}
 		if segmentNumber < oldestSegmentNumber {
 			oldestSegmentNumber = segmentNumber
@@ -222,107 +726,244 @@ func getOldestSegmentFile(files []string) (string, error) {
 func (wal *WriteAheadLog) Close() error {
 	// Stop the periodic sync timer
 	wal.cancel()
-	// Sync before closing
-	if err := wal.Sync(); err != nil {
-		return err
+	// Write the records queued by AppendAsync
+	wal.stopAppends()
+	// Let a scrub pass in progress notice the cancellation
+	<-wal.scrubDone
+	// Deliver pending lifecycle events once the final sync is done
+	defer wal.hooks.close()
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	// Sync before closing, the files are closed either way
+	err := wal.sealSegment(false)
+	if err != nil {
+		wal.resolveDurable(err)
 	}
-	// Close the current segment file
-	return wal.currSegmentFile.Close()
+	return errors.Join(err, wal.closeFiles())
 }
 
-func (wal *WriteAheadLog) writeToBuffer(marshaledRecord []byte) error {
-	recordSize := int32(len(marshaledRecord))
-	// write the record size to the buffer
-	if err := binary.Write(wal.bufferWriter, binary.LittleEndian, recordSize); err != nil {
-		return fmt.Errorf("failed to write record size: %w", err)
+// closeFiles closes the current segment file and blob file.
+func (wal *WriteAheadLog) closeFiles() error {
+	var blobErr error
+	if wal.blobFile != nil {
+		blobErr = wal.blobFile.Close()
 	}
-	// write the marshaled record to the buffer
-	_, err := wal.bufferWriter.Write(marshaledRecord)
+	return errors.Join(blobErr, wal.currSegmentFile.Close())
+}
 
-	return err
+// writeToBuffer writes an encoded record, whose first 4 bytes are reserved for
+// the length header, framed like the current segment. It returns the offset
+// the record starts at.
+func (wal *WriteAheadLog) writeToBuffer(encodedRecord []byte) (int64, error) {
+	if wal.blockFraming {
+		return wal.writeFragments(encodedRecord[4:])
+	}
+
+	recordOffset := wal.currSegmentSize
+	recordSize := int32(len(encodedRecord) - 4)
+	binary.LittleEndian.PutUint32(encodedRecord[:4], uint32(recordSize))
+
+	// write the record size and the marshaled record to the buffer
+	return recordOffset, wal.writeBytes(encodedRecord)
 }
 
-// TODO: Do not read all records, just get the last log sequence number
-func (wal *WriteAheadLog) getLastLogSequenceNumber() (uint64, error) {
-	records, err := wal.ReadAllRecords()
-	if err != nil {
-		return 0, err
+// writeBytes appends data to the records of the current segment.
+func (wal *WriteAheadLog) writeBytes(data []byte) error {
+	if _, err := wal.bufferWriter.Write(data); err != nil {
+		return err
+	}
+
+	wal.currSegmentSize += int64(len(data))
+	wal.unsyncedBytes += int64(len(data))
+	index := wal.currentIndex()
+	index.checksum = crc32.Update(index.checksum, crc32.IEEETable, data)
+	return nil
+}
+
+// reserveInFlight makes room for size more unsynced bytes. When the disk fell
+// behind the writer syncs itself, or gets ErrBackpressure with rejectWhenFull.
+// A single record larger than the limit is let through once nothing is in
+// flight.
+func (wal *WriteAheadLog) reserveInFlight(size int64) error {
+	if wal.maxInFlightBytes == 0 || wal.unsyncedBytes == 0 || wal.unsyncedBytes+size <= wal.maxInFlightBytes {
+		return nil
 	}
-	if len(records) == 0 {
-		return 0, nil // No records found, return 0
+	if wal.rejectWhenFull {
+		return ErrBackpressure
+	}
+	return wal.sync()
+}
+
+// keepScratchBuffer keeps a grown encoding buffer for the next record, unless
+// an unusually large record made it too big to hold on to.
+func (wal *WriteAheadLog) keepScratchBuffer(buffer []byte) {
+	if cap(buffer) <= maxScratchBufferSize {
+		wal.scratchBuffer = buffer
+	} else {
+		wal.scratchBuffer = nil
 	}
-	lastRecord := records[len(records)-1]
-	return lastRecord.GetLogSequenceNumber(), nil
 }
 
 func (wal *WriteAheadLog) syncPeriodically() {
 	for {
 		select {
-		case <-wal.syncTimer.C:
-			wal.lock.Lock()
+		case <-wal.syncTimer.C():
 			err := wal.Sync()
-			wal.lock.Unlock()
 
 			if err != nil {
 				fmt.Printf("Error syncing WAL: %v\n", err)
 			}
 
+			if wal.maxSegmentAge > 0 {
+				if err := wal.expireSegments(); err != nil {
+					fmt.Printf("Error deleting expired WAL segments: %v\n", err)
+				}
+			}
+
 		case <-wal.context.Done():
 			return
 		}
 	}
 }
 
+// Sync flushes buffered records and, with EnableForceSync, makes them durable.
+// Once a sync failed, Sync keeps returning its error: records written before
+// it may be lost and nothing written after them can be made durable.
 func (wal *WriteAheadLog) Sync() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.sync()
+}
+
+// sync is Sync for callers that already hold wal.lock. A failed sync is
+// sticky: the kernel may have dropped the pages it failed to write back, so
+// neither the records it covered nor any later ones, which recovery only keeps
+// behind them, can be made durable by syncing again. Every later sync, and
+// every record waiting for one, fails with its error.
+func (wal *WriteAheadLog) sync() error {
+	if wal.syncErr == nil {
+		wal.syncErr = wal.writeBack()
+	}
+	if wal.syncErr != nil {
+		wal.resolveDurable(wal.syncErr)
+		return wal.syncErr
+	}
+
+	if wal.hooks != nil && wal.lastSyncedLSN != wal.lastLogSequenceNumber {
+		syncedSegment := wal.currentSegmentInfo()
+		// A record split into parts is not covered before its last part
+		syncedSegment.LastLSN = min(syncedSegment.LastLSN, wal.lastLogSequenceNumber)
+		wal.hooks.push(func(hooks Hooks) { hooks.OnSync(syncedSegment) })
+	}
+	wal.lastSyncedLSN = wal.lastLogSequenceNumber
+	wal.unsyncedBytes = 0
+	wal.resolveDurable(nil)
+
+	wal.syncTimer.Reset(wal.syncInterval)
+	return nil
+}
+
+// writeBack flushes the buffered records and, with force sync, makes them and
+// the blobs they point to durable.
+func (wal *WriteAheadLog) writeBack() error {
+	if err := wal.syncBlobFile(); err != nil {
+		return err
+	}
 	if err := wal.bufferWriter.Flush(); err != nil {
 		return fmt.Errorf("failed to flush buffer: %w", err)
 	}
-
-	if wal.shouldForceSync {
-		if err := wal.currSegmentFile.Sync(); err != nil {
-			return fmt.Errorf("failed to sync segment file: %w", err)
-		}
+	if !wal.shouldForceSync {
+		return nil
 	}
 
-	wal.syncTimer.Reset(SyncInterval)
+	var err error
+	switch {
+	case wal.syncMode.writesAreDurable():
+		// The flush already wrote through to the device
+	case wal.syncMode == SyncModeFdatasync:
+		err = datasyncFile(wal.currSegmentFile)
+	default:
+		err = wal.currSegmentFile.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync segment file: %w", err)
+	}
 	return nil
 }
 
-func loadLastSegmentFile(config *Config) (*os.File, int, error) {
-	files, err := filepath.Glob(filepath.Join(config.Directory, SegmentPrefix+"*"))
+// loadLastSegmentFile opens the newest segment for writing, creating the first
+// one for an empty directory. It also returns the size of the records in it.
+func loadLastSegmentFile(config *Config) (File, uint64, int64, error) {
+	files, err := config.FS.Glob(filepath.Join(config.Directory, config.SegmentNaming.pattern()))
 	if err != nil {
-		return nil, 1, fmt.Errorf("failed reading WAL files: %w", err)
+		return nil, 1, 0, fmt.Errorf("failed reading WAL files: %w", err)
 	}
 
 	// No existing WAL files, create a new one
 	if len(files) == 0 {
-		file, err := createNewSegmentFile(config.Directory, 1)
+		var preallocateSize int64
+		if config.PreallocateSegments {
+			preallocateSize = config.MaxFileSize
+		}
+
+		// The first record has LSN 1, so this is also the right base LSN
+		segmentFilePath := filepath.Join(config.Directory, config.SegmentNaming.fileName(1))
+		file, err := createNewSegmentFile(config.FS, segmentFilePath, preallocateSize, config.SyncMode.openFlags())
 		if err != nil {
-			return nil, 1, fmt.Errorf("failed creating new WAL segment file: %w", err)
+			return nil, 1, 0, fmt.Errorf("failed creating new WAL segment file: %w", err)
 		}
 
-		return file, 1, nil
+		return file, 1, 0, nil
+	}
+
+	lastSegmentFileNumber, err := getLastSegmentFileNumber(files, config.SegmentNaming)
+	if err != nil {
+		return nil, 1, 0, fmt.Errorf("failed getting last segment file number: %w", err)
+	}
+
+	segmentFilePath := filepath.Join(config.Directory, config.SegmentNaming.fileName(lastSegmentFileNumber))
+	keepSpace := config.PreallocateSegments || config.RecycleSegments
+	segmentSize, err := repairSegmentFile(config.FS, config.Directory, segmentFilePath, keepSpace)
+	if err != nil {
+		return nil, lastSegmentFileNumber, 0, fmt.Errorf("failed repairing last segment file: %w", err)
 	}
 
-	lastSegmentFileNumber, err := getLastSegmentFileNumber(files)
+	file, err := config.FS.OpenFile(segmentFilePath, os.O_WRONLY|config.SyncMode.openFlags(), 0644)
 	if err != nil {
-		return nil, 1, fmt.Errorf("failed getting last segment file number: %w", err)
+		return nil, lastSegmentFileNumber, 0, fmt.Errorf("failed opening last segment file: %w", err)
 	}
 
-	segmentFilePath := filepath.Join(config.Directory, fmt.Sprintf("%s%d.log", SegmentPrefix, lastSegmentFileNumber))
-	file, err := os.OpenFile(segmentFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return file, lastSegmentFileNumber, segmentSize, nil
+}
+
+// listSegmentFiles returns the segment files in dir ordered by segment number.
+func listSegmentFiles(fs FS, dir string, naming SegmentNaming) ([]string, error) {
+	files, err := fs.Glob(filepath.Join(dir, naming.pattern()))
 	if err != nil {
-		return nil, lastSegmentFileNumber, fmt.Errorf("failed opening last segment file: %w", err)
+		return nil, fmt.Errorf("failed reading WAL files: %w", err)
 	}
 
-	return file, lastSegmentFileNumber, nil
+	segmentNumbers := make(map[string]uint64, len(files))
+	for _, file := range files {
+		segmentNumber, err := naming.parse(file)
+		if err != nil {
+			return nil, err
+		}
+		segmentNumbers[file] = segmentNumber
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return segmentNumbers[files[i]] < segmentNumbers[files[j]]
+	})
+
+	return files, nil
 }
 
-func getLastSegmentFileNumber(files []string) (int, error) {
-	var lastSegmentNumber int = 0
+func getLastSegmentFileNumber(files []string, naming SegmentNaming) (uint64, error) {
+	var lastSegmentNumber uint64 = 0
 	for _, file := range files {
-		var segmentNumber int
-		_, err := fmt.Sscanf(filepath.Base(file), SegmentPrefix+"%d.log", &segmentNumber)
+		segmentNumber, err := naming.parse(file)
 		if err != nil {
 			return 0, err
 		}
@@ -334,14 +975,41 @@ func getLastSegmentFileNumber(files []string) (int, error) {
 	return lastSegmentNumber, nil
 }
 
-func createNewSegmentFile(dir string, segmentId int) (*os.File, error) {
-	fileName := fmt.Sprintf("%s%d.log", SegmentPrefix, segmentId)
-	filePath := filepath.Join(dir, fileName)
+// createNewSegmentFile creates an empty segment, preallocated to
+// preallocateSize bytes when that is not zero, and makes its directory entry
+// durable. It never opens an existing file, so a segment cannot be truncated.
+// extraFlags are added to the open flags, e.g. for the sync mode.
+func createNewSegmentFile(fs FS, filePath string, preallocateSize int64, extraFlags int) (File, error) {
+	dir := filepath.Dir(filePath)
 
-	file, err := os.Create(filePath)
+	file, err := fs.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL|extraFlags, 0666)
 	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("refusing to overwrite existing segment %s: %w", filePath, err)
+		}
 		return nil, err
 	}
 
+	if preallocateSize > 0 {
+		if err := allocateFile(file, preallocateSize); err != nil {
+			file.Close()
+			fs.Remove(filePath)
+			return nil, fmt.Errorf("failed to preallocate segment: %w", err)
+		}
+		// Persist the new size now, so later fsyncs only have data to flush
+		if err := file.Sync(); err != nil {
+			file.Close()
+			fs.Remove(filePath)
+			return nil, err
+		}
+	}
+
+	if err := fs.SyncDir(dir); err != nil {
+		// Remove the segment so the next rotation can retry
+		file.Close()
+		fs.Remove(filePath)
+		return nil, fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+
 	return file, nil
 }
@@ -27,6 +27,12 @@ type WalRecord struct {
 	LogSequenceNumber uint64                 `protobuf:"varint,1,opt,name=LogSequenceNumber,proto3" json:"LogSequenceNumber,omitempty"`
 	Timestamp         int64                  `protobuf:"varint,2,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
 	Checksum          uint32                 `protobuf:"varint,4,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
+	Codec             uint32                 `protobuf:"varint,5,opt,name=Codec,proto3" json:"Codec,omitempty"`
+	KeyId             uint32                 `protobuf:"varint,6,opt,name=KeyId,proto3" json:"KeyId,omitempty"`
+	PrevHash          []byte                 `protobuf:"bytes,7,opt,name=PrevHash,proto3" json:"PrevHash,omitempty"`
+	Part              uint32                 `protobuf:"varint,8,opt,name=Part,proto3" json:"Part,omitempty"`
+	Continued         bool                   `protobuf:"varint,9,opt,name=Continued,proto3" json:"Continued,omitempty"`
+	Blob              *BlobPointer           `protobuf:"bytes,10,opt,name=Blob,proto3" json:"Blob,omitempty"`
 	unknownFields     protoimpl.UnknownFields
 	sizeCache         protoimpl.SizeCache
 }
@@ -89,15 +95,137 @@ func (x *WalRecord) GetChecksum() uint32 {
 	return 0
 }
 
+func (x *WalRecord) GetCodec() uint32 {
+	if x != nil {
+		return x.Codec
+	}
+	return 0
+}
+
+func (x *WalRecord) GetKeyId() uint32 {
+	if x != nil {
+		return x.KeyId
+	}
+	return 0
+}
+
+func (x *WalRecord) GetPrevHash() []byte {
+	if x != nil {
+		return x.PrevHash
+	}
+	return nil
+}
+
+func (x *WalRecord) GetPart() uint32 {
+	if x != nil {
+		return x.Part
+	}
+	return 0
+}
+
+func (x *WalRecord) GetContinued() bool {
+	if x != nil {
+		return x.Continued
+	}
+	return false
+}
+
+func (x *WalRecord) GetBlob() *BlobPointer {
+	if x != nil {
+		return x.Blob
+	}
+	return nil
+}
+
+type BlobPointer struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	File          uint64                 `protobuf:"varint,1,opt,name=File,proto3" json:"File,omitempty"`
+	Offset        int64                  `protobuf:"varint,2,opt,name=Offset,proto3" json:"Offset,omitempty"`
+	Length        int64                  `protobuf:"varint,3,opt,name=Length,proto3" json:"Length,omitempty"`
+	Checksum      uint32                 `protobuf:"varint,4,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlobPointer) Reset() {
+	*x = BlobPointer{}
+	mi := &file_proto_walproto_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlobPointer) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlobPointer) ProtoMessage() {}
+
+func (x *BlobPointer) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_walproto_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlobPointer.ProtoReflect.Descriptor instead.
+func (*BlobPointer) Descriptor() ([]byte, []int) {
+	return file_proto_walproto_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BlobPointer) GetFile() uint64 {
+	if x != nil {
+		return x.File
+	}
+	return 0
+}
+
+func (x *BlobPointer) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *BlobPointer) GetLength() int64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+func (x *BlobPointer) GetChecksum() uint32 {
+	if x != nil {
+		return x.Checksum
+	}
+	return 0
+}
+
 var File_proto_walproto_proto protoreflect.FileDescriptor
 
 const file_proto_walproto_proto_rawDesc = "" +
 	"\n" +
-	"\x14proto/walproto.proto\"\x87\x01\n" +
+	"\x14proto/walproto.proto\"\xa3\x02\n" +
 	"\tWalRecord\x12\x12\n" +
 	"\x04Data\x18\x03 \x01(\fR\x04Data\x12,\n" +
 	"\x11LogSequenceNumber\x18\x01 \x01(\x04R\x11LogSequenceNumber\x12\x1c\n" +
 	"\tTimestamp\x18\x02 \x01(\x03R\tTimestamp\x12\x1a\n" +
+	"\bChecksum\x18\x04 \x01(\rR\bChecksum\x12\x14\n" +
+	"\x05Codec\x18\x05 \x01(\rR\x05Codec\x12\x14\n" +
+	"\x05KeyId\x18\x06 \x01(\rR\x05KeyId\x12\x1a\n" +
+	"\bPrevHash\x18\a \x01(\fR\bPrevHash\x12\x12\n" +
+	"\x04Part\x18\b \x01(\rR\x04Part\x12\x1c\n" +
+	"\tContinued\x18\t \x01(\bR\tContinued\x12 \n" +
+	"\x04Blob\x18\n" +
+	" \x01(\v2\f.BlobPointerR\x04Blob\"m\n" +
+	"\vBlobPointer\x12\x12\n" +
+	"\x04File\x18\x01 \x01(\x04R\x04File\x12\x16\n" +
+	"\x06Offset\x18\x02 \x01(\x03R\x06Offset\x12\x16\n" +
+	"\x06Length\x18\x03 \x01(\x03R\x06Length\x12\x1a\n" +
 	"\bChecksum\x18\x04 \x01(\rR\bChecksumB\x10Z\x0ewalproto/protob\x06proto3"
 
 var (
@@ -112,16 +240,18 @@ func file_proto_walproto_proto_rawDescGZIP() []byte {
 	return file_proto_walproto_proto_rawDescData
 }
 
-var file_proto_walproto_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_proto_walproto_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_proto_walproto_proto_goTypes = []any{
-	(*WalRecord)(nil), // 0: WalRecord
+	(*WalRecord)(nil),   // 0: WalRecord
+	(*BlobPointer)(nil), // 1: BlobPointer
 }
 var file_proto_walproto_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	1, // 0: WalRecord.Blob:type_name -> BlobPointer
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_proto_walproto_proto_init() }
@@ -135,7 +265,7 @@ func file_proto_walproto_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_walproto_proto_rawDesc), len(file_proto_walproto_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
 		},